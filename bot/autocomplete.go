@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// Discord allows at most 25 autocomplete choices
+	maxChoices = 25
+	// Discord rejects choice names and string values longer than this
+	maxChoiceLength = 100
+)
+
+// autocomplete suggests values for the focused option of a command
+func autocomplete(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
+	focused, siblings := focusedOption(i.ApplicationCommandData().Options)
+	if focused == nil {
+		return
+	}
+	ctx, cancel := responseContext(i)
+	defer cancel()
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	switch focused.Name {
+	case "url", "calendar":
+		choices = calendarChoices(ctx, i.GuildID, focused.StringValue(), cmd)
+	case "field":
+		choices = fieldChoices(ctx, i.GuildID, stringOption(optionValues(siblings), "url"), focused.StringValue(), cmd)
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: choices,
+		},
+	})
+	if err != nil {
+		slog.Default().Error("error sending autocomplete choices", slog.String("option", focused.Name), slog.Any("error", err))
+	}
+}
+
+// focusedOption finds the option being typed in, descending into
+// subcommands, and returns it along with the other options next to it.
+func focusedOption(options []*discordgo.ApplicationCommandInteractionDataOption) (*discordgo.ApplicationCommandInteractionDataOption, []*discordgo.ApplicationCommandInteractionDataOption) {
+	for _, opt := range options {
+		switch {
+		case opt.Type == discordgo.ApplicationCommandOptionSubCommand || opt.Type == discordgo.ApplicationCommandOptionSubCommandGroup:
+			if focused, siblings := focusedOption(opt.Options); focused != nil {
+				return focused, siblings
+			}
+		case opt.Focused:
+			return opt, options
+		}
+	}
+	return nil, nil
+}
+
+// calendarChoices suggests the guild's calendars whose name or URL contain
+// what has been typed so far
+func calendarChoices(ctx context.Context, guildID, typed string, cmd c.Commands) []*discordgo.ApplicationCommandOptionChoice {
+	calendars, err := cmd.Calendars(ctx, guildID)
+	if err != nil {
+		slog.Default().Error("error fetching calendars for autocomplete", slog.String("guildID", guildID), slog.Any("error", err))
+		return nil
+	}
+	typed = strings.ToLower(typed)
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, min(len(calendars), maxChoices))
+	for _, cal := range calendars {
+		// Longer URLs can't be used as a choice value and have to be typed out
+		if len(cal.URL) > maxChoiceLength {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(cal.DisplayName()), typed) && !strings.Contains(strings.ToLower(cal.URL), typed) {
+			continue
+		}
+		name := cal.URL
+		if displayName := cal.DisplayName(); displayName != cal.URL {
+			name = fmt.Sprintf("%s (%s)", displayName, cal.URL)
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+			Name:  truncate(name, maxChoiceLength),
+			Value: cal.URL,
+		})
+		if len(choices) == maxChoices {
+			break
+		}
+	}
+	return choices
+}
+
+// fieldChoices suggests the fields that are actually set on the chosen
+// calendar's events, or every text field if the calendar isn't known yet
+func fieldChoices(ctx context.Context, guildID, url, typed string, cmd c.Commands) []*discordgo.ApplicationCommandOptionChoice {
+	fields := store.TextFields
+	if url != "" {
+		events, err := cmd.Events(ctx, guildID, url, time.Time{}, time.Time{})
+		if err != nil {
+			slog.Default().Error("error fetching events for autocomplete", slog.String("url", url), slog.Any("error", err))
+		} else if len(events) > 0 {
+			fields = store.TextFieldsWithValues(events)
+		}
+	}
+	typed = strings.ToLower(typed)
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(fields))
+	for _, field := range fields {
+		if strings.HasPrefix(field, typed) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{
+				Name:  field,
+				Value: field,
+			})
+		}
+	}
+	return choices
+}
@@ -5,13 +5,20 @@
 package bot
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/database"
 	"git.phlcode.club/discord-bot/store"
 	"git.phlcode.club/discord-bot/utils"
 	"github.com/bwmarrin/discordgo"
@@ -29,12 +36,67 @@ const (
 
 var (
 	eventPerm int64 = discordgo.PermissionManageEvents
+	zero            = 0.0
 	urlOpt          = discordgo.ApplicationCommandOption{
 		Type:        discordgo.ApplicationCommandOptionString,
 		Name:        "url",
 		Description: "URL for remote calendar",
 		Required:    true,
 	}
+	// subscribedURLOpt is the url option for commands acting on an existing
+	// subscription, it autocompletes the guild's calendars
+	subscribedURLOpt = discordgo.ApplicationCommandOption{
+		Type:         discordgo.ApplicationCommandOptionString,
+		Name:         "url",
+		Description:  "URL for remote calendar",
+		Required:     true,
+		Autocomplete: true,
+	}
+	modeOpt = discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "mode",
+		Description: "keep (include) or drop (exclude) matching events, defaults to include",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{
+				Name:  "include",
+				Value: store.FilterModeInclude,
+			},
+			{
+				Name:  "exclude",
+				Value: store.FilterModeExclude,
+			},
+		},
+	}
+	expressionOpt = discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "expression",
+		Description: `filter expression, e.g. name contains "Workshop" AND NOT location = Online`,
+		MaxLength:   1000,
+	}
+	patternTypeOpt = discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "pattern_type",
+		Description: "how the pattern is matched, defaults to substring",
+		Choices: []*discordgo.ApplicationCommandOptionChoice{
+			{
+				Name:  "substring",
+				Value: store.PatternSubstring,
+			},
+			{
+				Name:  "glob (* and ? wildcards)",
+				Value: store.PatternGlob,
+			},
+			{
+				Name:  "regex",
+				Value: store.PatternRegex,
+			},
+		},
+	}
+	caseInsensitiveOpt = discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionBoolean,
+		Name:        "case_insensitive",
+		Description: "ignore case when matching text, defaults to true",
+	}
 	commands = []*discordgo.ApplicationCommand{
 		{
 			ID:                       "phl-code-club-cal-bot-subscribe",
@@ -46,29 +108,25 @@ var (
 			Options: []*discordgo.ApplicationCommandOption{
 				&urlOpt,
 				{
-					Type:        discordgo.ApplicationCommandOptionString,
-					Name:        "field",
-					Description: "field to filter on",
-					Choices: []*discordgo.ApplicationCommandOptionChoice{
-						{
-							Name:  "name",
-							Value: "name",
-						},
-						{
-							Name:  "summary",
-							Value: "summary",
-						},
-						{
-							Name:  "location",
-							Value: "location",
-						},
-					},
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "field",
+					Description:  "field to filter on",
+					Autocomplete: true,
 				},
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "pattern",
 					Description: "filter pattern",
 				},
+				&patternTypeOpt,
+				&expressionOpt,
+				&modeOpt,
+				&caseInsensitiveOpt,
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "more_filters",
+					Description: "open a form to enter several include and exclude filters",
+				},
 			},
 		},
 		{
@@ -79,43 +137,354 @@ var (
 			Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
 			IntegrationTypes:         &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
 			Options: []*discordgo.ApplicationCommandOption{
-				&urlOpt,
+				&subscribedURLOpt,
 			},
 		},
 		{
 			ID:                       "phl-code-club-cal-bot-filter",
 			Name:                     "filter",
-			Description:              "Add filter to existing calendar and reprocess events",
+			Description:              "Manage the filters applied to a calendar's events",
 			DefaultMemberPermissions: &eventPerm,
 			Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
 			IntegrationTypes:         &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
 			Options: []*discordgo.ApplicationCommandOption{
-				&urlOpt,
 				{
-					Type:        discordgo.ApplicationCommandOptionString,
-					Name:        "field",
-					Required:    true,
-					Description: "field to filter on",
-					Choices: []*discordgo.ApplicationCommandOptionChoice{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Add filter to existing calendar and reprocess events",
+					Options: []*discordgo.ApplicationCommandOption{
+						&subscribedURLOpt,
 						{
-							Name:  "name",
-							Value: "name",
+							Type:         discordgo.ApplicationCommandOptionString,
+							Name:         "field",
+							Description:  "field to filter on",
+							Autocomplete: true,
 						},
 						{
-							Name:  "summary",
-							Value: "summary",
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "pattern",
+							Description: "filter pattern",
 						},
+						&patternTypeOpt,
+						&expressionOpt,
+						&modeOpt,
+						&caseInsensitiveOpt,
 						{
-							Name:  "location",
-							Value: "location",
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "preview",
+							Description: "preview the changes before applying them, defaults to true",
 						},
 					},
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List the filters applied to a calendar",
+					Options: []*discordgo.ApplicationCommandOption{
+						&subscribedURLOpt,
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Remove a filter and import the events it was excluding",
+					Options: []*discordgo.ApplicationCommandOption{
+						&subscribedURLOpt,
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "id",
+							Description: "ID of the filter, as shown by /filter list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		{
+			ID:                       "phl-code-club-cal-bot-calendar",
+			Name:                     "calendar",
+			Description:              "Manage how a subscribed calendar's events are imported",
+			DefaultMemberPermissions: &eventPerm,
+			Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+			IntegrationTypes:         &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "rewrite",
+					Description: "Rewrite the text of imported events",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "add",
+							Description: "Add a rewrite rule and update the imported events",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "field",
+									Description: "field to rewrite",
+									Required:    true,
+									Choices: []*discordgo.ApplicationCommandOptionChoice{
+										{Name: "name", Value: store.RewriteFieldName},
+										{Name: "description", Value: store.RewriteFieldDescription},
+										{Name: "location", Value: store.RewriteFieldLocation},
+									},
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "action",
+									Description: "how to rewrite the field",
+									Required:    true,
+									Choices: []*discordgo.ApplicationCommandOptionChoice{
+										{Name: "replace regex pattern with text", Value: store.RewriteReplace},
+										{Name: "strip pattern", Value: store.RewriteStrip},
+										{Name: "add text as a prefix", Value: store.RewritePrefix},
+										{Name: "add text as a suffix", Value: store.RewriteSuffix},
+									},
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "pattern",
+									Description: "regex to replace or text to strip",
+									MaxLength:   200,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "text",
+									Description: "replacement, prefix or suffix text, replacements can use $1 for groups",
+									MaxLength:   200,
+								},
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "list",
+							Description: "List the rewrite rules applied to a calendar",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "remove",
+							Description: "Remove a rewrite rule and update the imported events",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionInteger,
+									Name:        "id",
+									Description: "ID of the rule, as shown by /calendar rewrite list",
+									Required:    true,
+								},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "channel",
+					Description: "Host events in a voice or stage channel based on their location",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "add",
+							Description: "Host events whose location matches a pattern in a channel",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "pattern",
+									Description: "location pattern, e.g. Discord or zoom.us, ignoring case",
+									Required:    true,
+									MaxLength:   200,
+								},
+								{
+									Type:         discordgo.ApplicationCommandOptionChannel,
+									Name:         "channel",
+									Description:  "voice or stage channel to host matching events in",
+									Required:     true,
+									ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildVoice, discordgo.ChannelTypeGuildStageVoice},
+								},
+								&patternTypeOpt,
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "list",
+							Description: "List the channel rules of a calendar",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "remove",
+							Description: "Remove a channel rule, moving its events back to their location",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionInteger,
+									Name:        "id",
+									Description: "ID of the rule, as shown by /calendar channel list",
+									Required:    true,
+								},
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "cover",
+					Description: "Default cover image for events without one of their own",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "set",
+							Description: "Upload the default cover image, PNG, JPEG, GIF or WebP up to 4 MiB",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionAttachment,
+									Name:        "image",
+									Description: "cover image, ideally 800x320",
+									Required:    true,
+								},
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "clear",
+							Description: "Remove the default cover image",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+							},
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommandGroup,
+					Name:        "settings",
+					Description: "Customize how a calendar's events are imported",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "show",
+							Description: "Show a calendar's settings",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+							},
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionSubCommand,
+							Name:        "set",
+							Description: "Change a calendar's settings, text settings are cleared with -",
+							Options: []*discordgo.ApplicationCommandOption{
+								&subscribedURLOpt,
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "display_name",
+									Description: "name shown instead of the remote calendar's",
+									MaxLength:   100,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "color",
+									Description: "embed color, e.g. #5865F2",
+									MaxLength:   7,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "emoji",
+									Description: "emoji prefixed to event names",
+									MaxLength:   64,
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "privacy",
+									Description: "who can see the events",
+									Choices: []*discordgo.ApplicationCommandOptionChoice{
+										{Name: "server members", Value: store.PrivacyGuildOnly},
+									},
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "default_duration",
+									Description: "length of events without an end, e.g. 90m, defaults to 1h",
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionString,
+									Name:        "default_location",
+									Description: "location of events without one",
+									MaxLength:   100,
+								},
+								{
+									Type:         discordgo.ApplicationCommandOptionChannel,
+									Name:         "announcement_channel",
+									Description:  "channel to post newly imported events to",
+									ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews},
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionBoolean,
+									Name:        "no_announcements",
+									Description: "stop announcing newly imported events",
+								},
+								{
+									Type:        discordgo.ApplicationCommandOptionInteger,
+									Name:        "horizon_days",
+									Description: "only import events starting within this many days, 0 for no limit",
+									MinValue:    &zero,
+									MaxValue:    365,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			ID:               "phl-code-club-cal-bot-calendars",
+			Name:             "calendars",
+			Description:      "List the calendars CalendarBot is subscribed to",
+			Contexts:         &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+			IntegrationTypes: &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
+		},
+		{
+			ID:               "phl-code-club-cal-bot-events",
+			Name:             "events",
+			Description:      "List upcoming events imported by CalendarBot",
+			Contexts:         &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+			IntegrationTypes: &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "calendar",
+					Description:  "URL of the calendar to list events for",
+					Autocomplete: true,
+				},
 				{
 					Type:        discordgo.ApplicationCommandOptionString,
-					Name:        "pattern",
-					Description: "filter pattern",
-					Required:    true,
+					Name:        "from",
+					Description: "list events from this date (YYYY-MM-DD)",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "to",
+					Description: "list events up to and including this date (YYYY-MM-DD)",
+				},
+			},
+		},
+		{
+			ID:                       "phl-code-club-cal-bot-timezone",
+			Name:                     "timezone",
+			Description:              "Show or set the timezone used for time based filters and dates",
+			DefaultMemberPermissions: &eventPerm,
+			Contexts:                 &[]discordgo.InteractionContextType{discordgo.InteractionContextGuild},
+			IntegrationTypes:         &[]discordgo.ApplicationIntegrationType{discordgo.ApplicationIntegrationGuildInstall},
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "IANA timezone name, e.g. America/New_York",
 				},
 			},
 		},
@@ -123,49 +492,66 @@ var (
 	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands){
 		"subscribe": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
 			content := ""
-			options := i.ApplicationCommandData().Options
-			switch len(options) {
-			case 0:
+			options := optionValues(i.ApplicationCommandData().Options)
+			url := stringOption(options, "url")
+			mode := stringOption(options, "mode")
+			if mode == "" {
+				mode = store.FilterModeInclude
+			}
+			ignoreCase := ignoreCaseOption(options)
+			expression, err := filterExpression(options)
+			var filter *store.Filter
+			if err == nil && expression != "" {
+				filter, err = store.NewFilter(url, mode, expression, ignoreCase)
+			}
+			moreFilters := false
+			if opt, ok := options["more_filters"]; ok {
+				moreFilters = opt.BoolValue()
+			}
+			switch {
+			case url == "":
 				content = "Input error: missing URL"
-			case 1:
-				url := options[0].StringValue()
-				err := cmd.Subscribe(url, i, nil)
-				if err != nil {
-					content = "Error subscribing to calendar: " + err.Error()
-					break
-				}
-				content = "URL: " + url
-			case 2:
-				switch options[1].Name {
-				case "field":
-					content = "Input error: missing filter option `pattern`"
-				case "pattern":
-					content = "Input error: missing filter option `field`"
-				default:
-					content = "Input error: invalid input options, missing additional optional field"
-				}
-			case 3:
-				url := options[0].StringValue()
-				field := options[1].StringValue()
-				pattern := options[2].StringValue()
-				filter, err := store.NewFilter(url, field, pattern)
-				if err != nil {
-					content = "Error subscribing with filter: " + err.Error()
-					break
-				}
-				err = cmd.Subscribe(url, i, filter)
+			case err != nil:
+				content = "Input error: " + err.Error()
+			case moreFilters:
+				key := pending.add(i, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+					filters, err := modalFilters(url, i.ModalSubmitData(), ignoreCase)
+					if err != nil {
+						err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+							Type: discordgo.InteractionResponseChannelMessageWithSource,
+							Data: &discordgo.InteractionResponseData{
+								Content: "Input error: " + err.Error(),
+								Flags:   discordgo.MessageFlagsEphemeral,
+							},
+						})
+						if err != nil {
+							slog.Default().Error("error sending response to subscribe filters", slog.Any("error", err))
+						}
+						return
+					}
+					runSubscribe(s, i, cmd, url, filters)
+				})
+				err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+					Type: discordgo.InteractionResponseModal,
+					Data: subscribeFilterModal(key, filter),
+				})
 				if err != nil {
-					content = "Error subscribing to calendar: " + err.Error()
-					break
+					slog.Default().Error("error sending filter form for subscribe command", slog.Any("error", err))
 				}
-				content = "SUBSCRIBE WITH FILTER"
+				return
 			default:
-				content = "Input error: invalid input options"
+				var filters store.Filters
+				if filter != nil {
+					filters = append(filters, *filter)
+				}
+				runSubscribe(s, i, cmd, url, filters)
+				return
 			}
-			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
 					Content: content,
+					Flags:   discordgo.MessageFlagsEphemeral,
 				},
 			})
 			if err != nil {
@@ -173,52 +559,261 @@ var (
 			}
 		},
 		"unsubscribe": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
-			content := ""
+			data := &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
 			options := i.ApplicationCommandData().Options
 			switch len(options) {
 			case 0:
-				content = "Input error: missing URL"
+				data.Content = "Input error: missing URL"
 			case 1:
-				// TODO: Implement unsubscribe
-				content = "UNSUBSCRIBE"
+				ctx, cancel := responseContext(i)
+				defer cancel()
+				url := options[0].StringValue()
+				cal, err := cmd.Calendar(ctx, i.GuildID, url)
+				if err != nil {
+					data.Content = "Error finding calendar: " + err.Error()
+					break
+				}
+				events, err := cmd.Events(ctx, i.GuildID, url, time.Time{}, time.Time{})
+				if err != nil {
+					data.Content = "Error fetching calendar events: " + err.Error()
+					break
+				}
+				key := pending.add(i, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+					runUnsubscribe(s, i, cmd, url)
+				})
+				data.Content = fmt.Sprintf("Unsubscribing from **%s** will remove %d Discord events and %d filters. Are you sure?", cal.DisplayName(), len(events), len(cal.Filters))
+				data.Components = confirmButtons(key, "Unsubscribe")
 			default:
-				content = "Input error: invalid input options"
+				data.Content = "Input error: invalid input options"
 			}
 			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
-				Data: &discordgo.InteractionResponseData{
-					Content: content,
-				},
+				Data: data,
 			})
 			if err != nil {
-				slog.Default().Error("error sending response to subscribe command", slog.Any("error", err))
+				slog.Default().Error("error sending response to unsubscribe command", slog.Any("error", err))
 			}
 		},
 		"filter": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
-			options := i.ApplicationCommandData().Options
-			url := options[0].StringValue()
-			field := options[1].StringValue()
-			pattern := options[2].StringValue()
-			err := cmd.Filter(url, field, pattern, i)
+			sub := i.ApplicationCommandData().Options[0]
+			if h, ok := filterHandlers[sub.Name]; ok {
+				h(s, i, cmd, optionValues(sub.Options))
+			}
+		},
+		"calendar": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
+			group := i.ApplicationCommandData().Options[0]
+			sub := group.Options[0]
+			if h, ok := calendarHandlers[group.Name][sub.Name]; ok {
+				h(s, i, cmd, optionValues(sub.Options))
+			}
+		},
+		"calendars": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
+			ctx, cancel := responseContext(i)
+			defer cancel()
+			data := &discordgo.InteractionResponseData{}
+			calendars, err := cmd.Calendars(ctx, i.GuildID)
+			if err != nil {
+				slog.Default().Error("error fetching calendars", slog.String("guildID", i.GuildID), slog.Any("error", err))
+				data.Content = "Error fetching calendars: " + err.Error()
+			} else {
+				data.Embeds, data.Components = calendarsMessage(calendars, 0)
+			}
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: data,
+			})
 			if err != nil {
-				slog.Default().Error("error filtering events", slog.String("url", url), slog.String("field", field), slog.String("pattern", pattern), slog.Any("error", err))
+				slog.Default().Error("error sending response to calendars command", slog.Any("error", err))
+			}
+		},
+		"events": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
+			ctx, cancel := responseContext(i)
+			defer cancel()
+			data := &discordgo.InteractionResponseData{}
+			options := optionValues(i.ApplicationCommandData().Options)
+			loc, err := cmd.Timezone(ctx, i.GuildID)
+			if err != nil {
+				slog.Default().Error("error fetching guild timezone", slog.String("guildID", i.GuildID), slog.Any("error", err))
+				loc = time.UTC
+			}
+			from, to, err := parseDateRange(stringOption(options, "from"), stringOption(options, "to"), loc)
+			if err != nil {
+				data.Content = "Input error: " + err.Error()
+			} else {
+				url := stringOption(options, "calendar")
+				events, err := cmd.Events(ctx, i.GuildID, url, from, to)
+				if err != nil {
+					slog.Default().Error("error fetching events", slog.String("guildID", i.GuildID), slog.Any("error", err))
+					data.Content = "Error fetching events: " + err.Error()
+				} else {
+					embed := eventsEmbed(i.GuildID, events)
+					// Events from a single calendar take on its color
+					if url != "" {
+						if cal, err := cmd.Calendar(ctx, i.GuildID, url); err == nil {
+							embed.Color = cal.Settings.Color
+						}
+					}
+					data.Embeds = []*discordgo.MessageEmbed{embed}
+				}
 			}
 			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: data,
+			})
+			if err != nil {
+				slog.Default().Error("error sending response to events command", slog.Any("error", err))
+			}
+		},
+		"timezone": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands) {
+			ctx, cancel := responseContext(i)
+			defer cancel()
+			var content string
+			options := optionValues(i.ApplicationCommandData().Options)
+			if name := stringOption(options, "name"); name != "" {
+				loc, err := cmd.SetTimezone(ctx, i.GuildID, name)
+				if err != nil {
+					content = "Error setting timezone: " + err.Error()
+				} else {
+					content = "Timezone set to " + loc.String()
+				}
+			} else {
+				loc, err := cmd.Timezone(ctx, i.GuildID)
+				if err != nil {
+					content = "Error fetching timezone: " + err.Error()
+				} else {
+					content = "Timezone is " + loc.String()
+				}
+			}
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
-					Content: "Filtered events",
+					Content: content,
+					Flags:   discordgo.MessageFlagsEphemeral,
 				},
 			})
 			if err != nil {
-				slog.Default().Error("error sending response to subscribe command", slog.Any("error", err))
+				slog.Default().Error("error sending response to timezone command", slog.Any("error", err))
 			}
 		},
 	}
+	// calendarHandlers handle the /calendar subcommands, keyed by group and
+	// then subcommand name
+	calendarHandlers = map[string]map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+		"rewrite":  rewriteHandlers,
+		"channel":  channelHandlers,
+		"cover":    coverHandlers,
+		"settings": settingsHandlers,
+	}
+	// componentHandlers are keyed by the prefix of the component's custom ID,
+	// everything after the first ':' is passed along as the argument.
+	componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string){
+		"confirm": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string) {
+			action, ok := pending.take(arg, i)
+			if !ok {
+				respondPendingMissing(s, i)
+				return
+			}
+			action.run(s, i)
+		},
+		"cancel": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string) {
+			if _, ok := pending.take(arg, i); !ok {
+				respondPendingMissing(s, i)
+				return
+			}
+			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: &discordgo.InteractionResponseData{
+					Content:    "Cancelled.",
+					Components: []discordgo.MessageComponent{},
+				},
+			})
+			if err != nil {
+				slog.Default().Error("error responding to cancel button", slog.Any("error", err))
+			}
+		},
+		"calendars": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string) {
+			page, err := strconv.Atoi(arg)
+			if err != nil {
+				slog.Default().Error("invalid calendars page", slog.String("page", arg), slog.Any("error", err))
+				return
+			}
+			ctx, cancel := responseContext(i)
+			defer cancel()
+			data := &discordgo.InteractionResponseData{}
+			calendars, err := cmd.Calendars(ctx, i.GuildID)
+			if err != nil {
+				slog.Default().Error("error fetching calendars", slog.String("guildID", i.GuildID), slog.Any("error", err))
+				data.Content = "Error fetching calendars: " + err.Error()
+			} else {
+				data.Embeds, data.Components = calendarsMessage(calendars, page)
+			}
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseUpdateMessage,
+				Data: data,
+			})
+			if err != nil {
+				slog.Default().Error("error updating calendars page", slog.Any("error", err))
+			}
+		},
+	}
+	// modalHandlers are keyed by the prefix of the modal's custom ID in the
+	// same way as componentHandlers.
+	modalHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string){
+		"subscribe": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, arg string) {
+			action, ok := pending.take(arg, i)
+			if !ok {
+				respondPendingMissing(s, i)
+				return
+			}
+			action.run(s, i)
+		},
+	}
 )
 
+// runUnsubscribe performs a confirmed unsubscribe and replaces the
+// confirmation prompt with a summary of what was removed.
+func runUnsubscribe(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, url string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		slog.Default().Error("error acknowledging unsubscribe confirmation", slog.Any("error", err))
+	}
+	ctx, cancel := deferredContext(i)
+	defer cancel()
+	result, err := cmd.Unsubscribe(ctx, url, i)
+	var content string
+	switch {
+	case err != nil && len(result.Failed) > 0:
+		content = fmt.Sprintf("Removed %d Discord events but could not remove: %s\nThe calendar is still subscribed, run `/unsubscribe` again to retry.", result.Removed, strings.Join(result.Failed, ", "))
+	case err != nil:
+		content = "Error unsubscribing from calendar: " + err.Error()
+	default:
+		content = fmt.Sprintf("Unsubscribed from %s and removed %d Discord events.", url, result.Removed)
+	}
+	if err != nil {
+		slog.Default().Error("error unsubscribing from calendar", slog.String("url", url), slog.Any("error", err))
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content:    &content,
+		Components: &[]discordgo.MessageComponent{},
+	})
+	if err != nil {
+		slog.Default().Error("error editing response to unsubscribe command", slog.Any("error", err))
+	}
+}
+
+// newStore returns the store for the database driver in use
+func newStore(driver string, db *sql.DB) store.Store {
+	if driver == database.DriverPostgres {
+		return store.NewPostgresStore(db)
+	}
+	return store.NewSQLiteStore(db)
+}
+
 func Run(db *sql.DB, token string) error {
-	store := store.NewSQLiteStore(db)
 	e := utils.GetEnv()
+	store := newStore(e.DBDriver, db)
 	appID := e.DiscordAppID
 	discord, err := discordgo.New("Bot " + token)
 	if err != nil {
@@ -229,10 +824,68 @@ func Run(db *sql.DB, token string) error {
 		logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	}
 	// TODO: Replace the default logger with a nicer library
-	cmds := c.NewCalendarCommands(*logger, store, discord)
+	session := c.NewDiscord(discord)
+	queue := c.NewQueue(*logger, store, session)
+	cmds := c.NewCalendarCommands(*logger, store, session, queue)
 	discord.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i, cmds)
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
+				h(s, i, cmds)
+			}
+		case discordgo.InteractionApplicationCommandAutocomplete:
+			autocomplete(s, i, cmds)
+		case discordgo.InteractionMessageComponent:
+			name, arg, _ := strings.Cut(i.MessageComponentData().CustomID, ":")
+			if h, ok := componentHandlers[name]; ok {
+				h(s, i, cmds, arg)
+			}
+		case discordgo.InteractionModalSubmit:
+			name, arg, _ := strings.Cut(i.ModalSubmitData().CustomID, ":")
+			if h, ok := modalHandlers[name]; ok {
+				h(s, i, cmds, arg)
+			}
+		}
+	})
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	var startWorkers sync.Once
+	discord.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		readyCtx, cancel := context.WithTimeout(ctx, readyTimeout)
+		defer cancel()
+		guildIDs := make([]string, len(r.Guilds))
+		for i, guild := range r.Guilds {
+			guildIDs[i] = guild.ID
+		}
+		err := cmds.AdoptCalendars(readyCtx, guildIDs)
+		if err != nil {
+			logger.Error("error assigning calendars subscribed before guilds", slog.Any("error", err))
+		}
+		// Creates left unrecorded by the last run are matched to their
+		// scheduled events before the queue could make them again
+		err = queue.Recover(readyCtx, r.User.ID)
+		if err != nil {
+			logger.Error("error recovering unrecorded discord ops", slog.Any("error", err))
+		}
+		startWorkers.Do(func() {
+			go queue.Run(ctx)
+			go cmds.Poll(ctx)
+		})
+	})
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.GuildScheduledEventDelete) {
+		ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout)
+		defer cancel()
+		err := cmds.ScheduledEventDeleted(ctx, event.GuildScheduledEvent)
+		if err != nil {
+			logger.Error("error reconciling deleted scheduled event", slog.String("id", event.ID), slog.Any("error", err))
+		}
+	})
+	discord.AddHandler(func(s *discordgo.Session, event *discordgo.GuildScheduledEventUpdate) {
+		ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout)
+		defer cancel()
+		err := cmds.ScheduledEventUpdated(ctx, event.GuildScheduledEvent)
+		if err != nil {
+			logger.Error("error reconciling updated scheduled event", slog.String("id", event.ID), slog.Any("error", err))
 		}
 	})
 	registeredCommands := make([]*discordgo.ApplicationCommand, len(commands))
@@ -0,0 +1,120 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	calendarsPerPage   = 5
+	calendarsTitle     = "Subscribed calendars"
+	maxFieldNameLength = 256
+	// Discord rejects embed field values longer than this
+	maxFieldValueLength = 1024
+	// Discord rejects embeds whose text adds up to more than this
+	maxEmbedLength = 6000
+	// footerAllowance is held back from maxEmbedLength for the page footer
+	footerAllowance = 100
+)
+
+// calendarsMessage renders a single page of the guild's subscribed calendars,
+// adding previous/next buttons when the list does not fit on one page.
+func calendarsMessage(calendars []store.Calendar, page int) ([]*discordgo.MessageEmbed, []discordgo.MessageComponent) {
+	if len(calendars) == 0 {
+		return []*discordgo.MessageEmbed{{
+			Title:       calendarsTitle,
+			Description: "This server is not subscribed to any calendars. Use `/subscribe` to add one.",
+		}}, nil
+	}
+
+	fieldPages := calendarPages(calendars)
+	pages := len(fieldPages)
+	page = max(0, min(page, pages-1))
+	embed := &discordgo.MessageEmbed{
+		Title:  calendarsTitle,
+		Fields: fieldPages[page],
+		Footer: &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Page %d of %d (%d calendars)", page+1, pages, len(calendars)),
+		},
+	}
+	if pages == 1 {
+		return []*discordgo.MessageEmbed{embed}, nil
+	}
+
+	return []*discordgo.MessageEmbed{embed}, []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    "Previous",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "calendars:" + strconv.Itoa(page-1),
+					Disabled: page == 0,
+				},
+				discordgo.Button{
+					Label:    "Next",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "calendars:" + strconv.Itoa(page+1),
+					Disabled: page == pages-1,
+				},
+			},
+		},
+	}
+}
+
+// calendarPages splits the calendars' fields into pages of at most
+// calendarsPerPage fields, cutting a page short when its text would take the
+// embed past Discord's length limit.
+func calendarPages(calendars []store.Calendar) [][]*discordgo.MessageEmbedField {
+	budget := maxEmbedLength - utf8.RuneCountInString(calendarsTitle) - footerAllowance
+	var pages [][]*discordgo.MessageEmbedField
+	var fields []*discordgo.MessageEmbedField
+	length := 0
+	for _, cal := range calendars {
+		field := &discordgo.MessageEmbedField{
+			Name:  truncate(cal.DisplayName(), maxFieldNameLength),
+			Value: calendarSummary(cal),
+		}
+		n := utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+		if len(fields) == calendarsPerPage || len(fields) > 0 && length+n > budget {
+			pages = append(pages, fields)
+			fields, length = nil, 0
+		}
+		fields = append(fields, field)
+		length += n
+	}
+	return append(pages, fields)
+}
+
+func calendarSummary(cal store.Calendar) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", cal.URL)
+	if cal.LastSynced.IsZero() {
+		b.WriteString("Last synced: never\n")
+	} else {
+		fmt.Fprintf(&b, "Last synced: <t:%d:R>\n", cal.LastSynced.Unix())
+	}
+	fmt.Fprintf(&b, "Active events: %d\n", cal.EventCount)
+	if len(cal.Filters) == 0 {
+		b.WriteString("Filters: none")
+	} else {
+		b.WriteString("Filters:")
+		for _, f := range cal.Filters {
+			fmt.Fprintf(&b, "\n- `#%d` %s", f.ID, describeFilter(f))
+		}
+	}
+	return truncate(b.String(), maxFieldValueLength)
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
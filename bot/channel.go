@@ -0,0 +1,117 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelHandlers handle the subcommands of the /calendar channel group
+var channelHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+	"add": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		patternType := stringOption(options, "pattern_type")
+		if patternType == "" {
+			patternType = store.PatternSubstring
+		}
+		var channelID string
+		if opt, ok := options["channel"]; ok {
+			channelID, _ = opt.Value.(string)
+		}
+		// Moving the imported events can take longer than Discord waits for a response
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to channel add command", slog.Any("error", err))
+		}
+		var content string
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		rule, result, err := cmd.AddChannelRule(ctx, url, patternType, stringOption(options, "pattern"), channelID, i)
+		switch {
+		case err != nil && rule.ID == 0:
+			content = "Error adding channel rule: " + err.Error()
+		case err != nil:
+			content = fmt.Sprintf("Added channel rule `#%d` but failed to update the calendar's events after updating %d: %s", rule.ID, len(result.Updated), err)
+		default:
+			content = fmt.Sprintf("Added channel rule `#%d` (%s) and moved %d events.", rule.ID, rule, len(result.Updated))
+		}
+		if err != nil {
+			slog.Default().Error("error adding channel rule", slog.String("url", url), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to channel add command", slog.Any("error", err))
+		}
+	},
+	"list": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		var content string
+		ctx, cancel := responseContext(i)
+		defer cancel()
+		rules, err := cmd.ChannelRules(ctx, i.GuildID, stringOption(options, "url"))
+		switch {
+		case err != nil:
+			content = "Error finding calendar: " + err.Error()
+		case len(rules) == 0:
+			content = "This calendar has no channel rules, its events are all created at their external location."
+		default:
+			var b strings.Builder
+			b.WriteString("Channel rules, the first matching rule wins:")
+			for _, r := range rules {
+				fmt.Fprintf(&b, "\n`#%d` %s", r.ID, r)
+			}
+			content = b.String()
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to channel list command", slog.Any("error", err))
+		}
+	},
+	"remove": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		id := options["id"].IntValue()
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to channel remove command", slog.Any("error", err))
+		}
+		var content string
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		rule, result, err := cmd.RemoveChannelRule(ctx, url, id, i)
+		switch {
+		case errors.Is(err, store.ErrChannelRuleNotFound):
+			content = fmt.Sprintf("Channel rule `#%d` does not exist, see `/calendar channel list`", id)
+		case err != nil && rule.ID == 0:
+			content = "Error removing channel rule: " + err.Error()
+		case err != nil:
+			content = fmt.Sprintf("Removed channel rule `#%d` but failed to update the calendar's events after updating %d: %s", id, len(result.Updated), err)
+		default:
+			content = fmt.Sprintf("Removed channel rule `#%d` (%s) and moved %d events.", id, rule, len(result.Updated))
+		}
+		if err != nil {
+			slog.Default().Error("error removing channel rule", slog.String("url", url), slog.Int64("id", id), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to channel remove command", slog.Any("error", err))
+		}
+	},
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// pendingTTL matches the lifetime of a Discord interaction token, after which
+// the original message can no longer be edited anyway.
+const pendingTTL = 15 * time.Minute
+
+// pendingAction is an action waiting for the user who requested it to press
+// a confirm button or submit a form.
+type pendingAction struct {
+	userID  string
+	expires time.Time
+	run     func(s *discordgo.Session, i *discordgo.InteractionCreate)
+}
+
+type pendingActions struct {
+	mu      sync.Mutex
+	actions map[string]pendingAction
+}
+
+var pending = pendingActions{actions: make(map[string]pendingAction)}
+
+// add registers an action under the interaction that requested it and
+// returns the key to embed in the confirm and cancel button or modal custom
+// IDs.
+func (p *pendingActions) add(i *discordgo.InteractionCreate, run func(s *discordgo.Session, i *discordgo.InteractionCreate)) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, action := range p.actions {
+		if now.After(action.expires) {
+			delete(p.actions, key)
+		}
+	}
+	p.actions[i.ID] = pendingAction{
+		userID:  interactionUserID(i),
+		expires: now.Add(pendingTTL),
+		run:     run,
+	}
+	return i.ID
+}
+
+// take removes and returns the action for key if it exists, has not expired
+// and was requested by the same user that is now responding to it.
+func (p *pendingActions) take(key string, i *discordgo.InteractionCreate) (pendingAction, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	action, ok := p.actions[key]
+	if !ok || action.userID != interactionUserID(i) {
+		return pendingAction{}, false
+	}
+	delete(p.actions, key)
+	if time.Now().After(action.expires) {
+		return pendingAction{}, false
+	}
+	return action, true
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
+
+// confirmButtons renders the confirm and cancel buttons for a pending action
+func confirmButtons(key, confirmLabel string) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{
+		discordgo.ActionsRow{
+			Components: []discordgo.MessageComponent{
+				discordgo.Button{
+					Label:    confirmLabel,
+					Style:    discordgo.DangerButton,
+					CustomID: "confirm:" + key,
+				},
+				discordgo.Button{
+					Label:    "Cancel",
+					Style:    discordgo.SecondaryButton,
+					CustomID: "cancel:" + key,
+				},
+			},
+		},
+	}
+}
+
+// respondPendingMissing tells the user the action they clicked on is no
+// longer available without touching the original message.
+func respondPendingMissing(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "This action has expired or was requested by someone else.",
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		slog.Default().Error("error responding to expired action", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,48 @@
+package bot
+
+import (
+	"context"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// responseWindow is how long Discord waits for the first response to an
+	// interaction before telling the user it failed
+	responseWindow = 3 * time.Second
+	// responseMargin is held back from the response window to send the
+	// response once the work is done
+	responseMargin = 500 * time.Millisecond
+	// deferredMargin is held back from the interaction token's lifetime to
+	// report a deferred command that ran out of time
+	deferredMargin = 30 * time.Second
+	// gatewayTimeout bounds handling a gateway event
+	gatewayTimeout = 10 * time.Second
+	// readyTimeout bounds the housekeeping done when the gateway is ready
+	readyTimeout = time.Minute
+)
+
+// interactionContext returns a context that is done margin before lifetime
+// has passed since Discord created the interaction.
+func interactionContext(i *discordgo.InteractionCreate, lifetime, margin time.Duration) (context.Context, context.CancelFunc) {
+	created, err := discordgo.SnowflakeTimestamp(i.ID)
+	if err != nil {
+		created = time.Now()
+	}
+	return context.WithDeadline(context.Background(), created.Add(lifetime-margin))
+}
+
+// responseContext is the context for work that has to finish before the
+// interaction is first responded to, such as autocomplete and commands that
+// reply straight away.
+func responseContext(i *discordgo.InteractionCreate) (context.Context, context.CancelFunc) {
+	return interactionContext(i, responseWindow, responseMargin)
+}
+
+// deferredContext is the context for work done after deferring the response,
+// which can go on for as long as the interaction token can still be used to
+// edit the response.
+func deferredContext(i *discordgo.InteractionCreate) (context.Context, context.CancelFunc) {
+	return interactionContext(i, pendingTTL, deferredMargin)
+}
@@ -0,0 +1,59 @@
+package bot
+
+import (
+	"log/slog"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"github.com/bwmarrin/discordgo"
+)
+
+// coverHandlers handle the subcommands of the /calendar cover group
+var coverHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+	"set": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		var imageURL string
+		if opt, ok := options["image"]; ok {
+			id, _ := opt.Value.(string)
+			if resolved := i.ApplicationCommandData().Resolved; resolved != nil {
+				if attachment, ok := resolved.Attachments[id]; ok {
+					imageURL = attachment.URL
+				}
+			}
+		}
+		runSetCover(s, i, cmd, stringOption(options, "url"), imageURL)
+	},
+	"clear": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		runSetCover(s, i, cmd, stringOption(options, "url"), "")
+	},
+}
+
+// runSetCover sets or clears the calendar's default cover image. Downloading
+// the image can take longer than Discord waits for a response so the response
+// is deferred.
+func runSetCover(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, url, imageURL string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral},
+	})
+	if err != nil {
+		slog.Default().Error("error sending response to cover command", slog.Any("error", err))
+	}
+	var content string
+	ctx, cancel := deferredContext(i)
+	defer cancel()
+	err = cmd.SetCover(ctx, i.GuildID, url, imageURL)
+	switch {
+	case err != nil:
+		slog.Default().Error("error setting calendar cover", slog.String("url", url), slog.Any("error", err))
+		content = "Error setting cover image: " + err.Error()
+	case imageURL == "":
+		content = "Removed the default cover image, events without an image of their own will have none."
+	default:
+		content = "Set the default cover image for events created or updated from now on that have no image of their own."
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	if err != nil {
+		slog.Default().Error("error editing response to cover command", slog.Any("error", err))
+	}
+}
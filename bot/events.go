@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// Discord allows at most 25 fields per embed
+	maxEmbedFields = 25
+)
+
+// parseDateRange turns the optional `from` and `to` date options into a time
+// range in the guild's timezone. `from` defaults to now and `to` is inclusive
+// of the whole day.
+func parseDateRange(from, to string, loc *time.Location) (time.Time, time.Time, error) {
+	start := time.Now()
+	if from != "" {
+		t, err := time.ParseInLocation(dateLayout, from, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid `from` date %q, expected YYYY-MM-DD", from)
+		}
+		start = t
+	}
+	var end time.Time
+	if to != "" {
+		t, err := time.ParseInLocation(dateLayout, to, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid `to` date %q, expected YYYY-MM-DD", to)
+		}
+		end = t.AddDate(0, 0, 1)
+		if !end.After(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("`to` date %s is before the start of the range", to)
+		}
+	}
+	return start, end, nil
+}
+
+// eventsEmbed renders the upcoming events with Discord timestamps and links
+// to the guild scheduled events the bot created.
+func eventsEmbed(guildID string, events []e.Event) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{Title: "Upcoming events"}
+	if len(events) == 0 {
+		embed.Description = "No upcoming events found."
+		return embed
+	}
+
+	shown := events[:min(len(events), maxEmbedFields)]
+	embed.Fields = make([]*discordgo.MessageEmbedField, 0, len(shown))
+	for _, event := range shown {
+		var b strings.Builder
+		fmt.Fprintf(&b, "<t:%d:F> (<t:%d:R>)", event.StartTime.Unix(), event.StartTime.Unix())
+		if event.Location != "" {
+			fmt.Fprintf(&b, "\n%s", event.Location)
+		}
+		fmt.Fprintf(&b, "\n[View event](https://discord.com/events/%s/%s)", guildID, event.ID)
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  truncate(event.Name, 256),
+			Value: truncate(b.String(), maxFieldValueLength),
+		})
+	}
+	if len(events) > len(shown) {
+		embed.Footer = &discordgo.MessageEmbedFooter{
+			Text: fmt.Sprintf("Showing %d of %d events, narrow the date range to see more", len(shown), len(events)),
+		}
+	}
+	return embed
+}
+
+// optionValues indexes the command options by name so optional options can
+// be looked up regardless of the order they were provided in.
+func optionValues(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	values := make(map[string]*discordgo.ApplicationCommandInteractionDataOption, len(options))
+	for _, opt := range options {
+		values[opt.Name] = opt
+	}
+	return values
+}
+
+// stringOption returns the string value of the named option or "" if it was
+// not provided
+func stringOption(options map[string]*discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	if opt, ok := options[name]; ok {
+		return opt.StringValue()
+	}
+	return ""
+}
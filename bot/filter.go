@@ -0,0 +1,276 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	e "git.phlcode.club/discord-bot/events"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+type filterOptions = map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+// filterHandlers handle the subcommands of the /filter command
+var filterHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+	"add": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		mode := stringOption(options, "mode")
+		if mode == "" {
+			mode = store.FilterModeInclude
+		}
+		expression, err := filterExpression(options)
+		if err == nil && expression == "" {
+			err = errors.New("provide either an `expression` or a `field` and `pattern`")
+		}
+		if err != nil {
+			err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: "Input error: " + err.Error(),
+					Flags:   discordgo.MessageFlagsEphemeral,
+				},
+			})
+			if err != nil {
+				slog.Default().Error("error sending response to filter add command", slog.Any("error", err))
+			}
+			return
+		}
+		preview := true
+		if opt, ok := options["preview"]; ok {
+			preview = opt.BoolValue()
+		}
+		// Resyncing fetches the feed, which can take longer than Discord waits for a response
+		data := &discordgo.InteractionResponseData{}
+		if preview {
+			data.Flags = discordgo.MessageFlagsEphemeral
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			Data: data,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to filter add command", slog.Any("error", err))
+		}
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		edit := &discordgo.WebhookEdit{}
+		if preview {
+			var p c.FilterPreview
+			p, err = cmd.PreviewFilter(ctx, url, mode, expression, ignoreCaseOption(options), i)
+			if err != nil {
+				content := filterErrorContent(err, expression)
+				edit.Content = &content
+			} else {
+				key := pending.add(i, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+					runApplyFilter(s, i, cmd, p)
+				})
+				components := confirmButtons(key, "Apply")
+				edit.Embeds = &[]*discordgo.MessageEmbed{filterPreviewEmbed(p)}
+				edit.Components = &components
+			}
+		} else {
+			var content string
+			var result c.SyncResult
+			result, err = cmd.Filter(ctx, url, mode, expression, ignoreCaseOption(options), i)
+			if err != nil {
+				content = filterErrorContent(err, expression)
+			} else {
+				content = fmt.Sprintf("Added %s filter `%s`: removed %d events and added %d events.", mode, expression, len(result.Removed), len(result.Added))
+			}
+			edit.Content = &content
+		}
+		if err != nil {
+			slog.Default().Error("error filtering events", slog.String("url", url), slog.String("mode", mode), slog.String("expression", expression), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, edit)
+		if err != nil {
+			slog.Default().Error("error editing response to filter add command", slog.Any("error", err))
+		}
+	},
+	"list": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		var content string
+		ctx, cancel := responseContext(i)
+		defer cancel()
+		cal, err := cmd.Calendar(ctx, i.GuildID, stringOption(options, "url"))
+		switch {
+		case err != nil:
+			content = "Error finding calendar: " + err.Error()
+		case len(cal.Filters) == 0:
+			content = fmt.Sprintf("**%s** has no filters.", cal.DisplayName())
+		default:
+			var b strings.Builder
+			fmt.Fprintf(&b, "Filters for **%s**:", cal.DisplayName())
+			for _, f := range cal.Filters {
+				fmt.Fprintf(&b, "\n`#%d` %s", f.ID, describeFilter(f))
+			}
+			b.WriteString("\nEvents are kept if they match any include filter (or there are none) and no exclude filter.")
+			content = b.String()
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to filter list command", slog.Any("error", err))
+		}
+	},
+	"remove": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		id := options["id"].IntValue()
+		// Re-fetching the feed can take longer than Discord waits for a response
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to filter remove command", slog.Any("error", err))
+		}
+		var content string
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		filter, result, err := cmd.RemoveFilter(ctx, url, id, i)
+		switch {
+		case errors.Is(err, store.ErrFilterNotFound):
+			content = fmt.Sprintf("Filter `#%d` does not exist, see `/filter list`", id)
+		case err != nil && filter.ID == 0:
+			content = "Error removing filter: " + err.Error()
+		case err != nil:
+			content = fmt.Sprintf("Removed filter `#%d` but failed to resync the calendar after removing %d and adding %d events: %s", id, len(result.Removed), len(result.Added), err)
+		default:
+			content = fmt.Sprintf("Removed filter `#%d` (%s), removed %d events and imported %d previously excluded events.", id, describeFilter(filter), len(result.Removed), len(result.Added))
+		}
+		if err != nil {
+			slog.Default().Error("error removing filter", slog.String("url", url), slog.Int64("id", id), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to filter remove command", slog.Any("error", err))
+		}
+	},
+}
+
+// filterExpression returns the filter expression given by either the
+// `expression` option or the `field`, `pattern` and `pattern_type` options, or
+// "" when no filter was given.
+func filterExpression(options filterOptions) (string, error) {
+	expression := stringOption(options, "expression")
+	field := stringOption(options, "field")
+	pattern := stringOption(options, "pattern")
+	patternType := stringOption(options, "pattern_type")
+	if patternType == "" {
+		patternType = store.PatternSubstring
+	}
+	switch {
+	case expression != "" && (field != "" || pattern != ""):
+		return "", errors.New("use either `expression` or `field` and `pattern`, not both")
+	case expression != "":
+		return expression, nil
+	case field != "" && pattern == "":
+		return "", errors.New("missing filter option `pattern`")
+	case field == "" && pattern != "":
+		return "", errors.New("missing filter option `field`")
+	case field != "":
+		return store.FieldExpression(field, patternType, pattern)
+	}
+	return "", nil
+}
+
+// ignoreCaseOption returns the `case_insensitive` option, which defaults to
+// true as admins rarely mean for "workshop" not to match "Workshop"
+func ignoreCaseOption(options filterOptions) bool {
+	if opt, ok := options["case_insensitive"]; ok {
+		return opt.BoolValue()
+	}
+	return true
+}
+
+// describeFilter renders the filter's mode and expression, noting when it
+// matches case
+func describeFilter(f store.Filter) string {
+	s := fmt.Sprintf("%s `%s`", f.Mode, f.Expr)
+	if !f.IgnoreCase {
+		s += " (case sensitive)"
+	}
+	return s
+}
+
+// filterErrorContent explains why a filter couldn't be added, pointing at the
+// problem in the expression for syntax errors
+func filterErrorContent(err error, expression string) string {
+	var syntaxErr *store.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Sprintf("Invalid filter expression: %s\n```\n%s\n%s^\n```", syntaxErr.Msg, expression, strings.Repeat(" ", max(0, syntaxErr.Pos-1)))
+	}
+	return "Error filtering events: " + err.Error()
+}
+
+// maxPreviewEvents is how many events of each kind a filter preview lists
+const maxPreviewEvents = 10
+
+// filterPreviewEmbed lists the events a filter would keep, remove and add
+func filterPreviewEmbed(p c.FilterPreview) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Title:       "Filter preview",
+		Description: fmt.Sprintf("Adding %s filter would make the following changes. Nothing has been changed yet.", describeFilter(p.Filter)),
+		Fields: []*discordgo.MessageEmbedField{
+			previewField("Kept", p.Keep),
+			previewField("Updated", p.Update),
+			previewField("Removed", p.Remove),
+			previewField("Newly added", p.Add),
+		},
+	}
+}
+
+func previewField(name string, events []e.Event) *discordgo.MessageEmbedField {
+	field := &discordgo.MessageEmbedField{Name: fmt.Sprintf("%s (%d)", name, len(events))}
+	if len(events) == 0 {
+		field.Value = "none"
+		return field
+	}
+	var b strings.Builder
+	for _, event := range events[:min(len(events), maxPreviewEvents)] {
+		fmt.Fprintf(&b, "- <t:%d:d> %s\n", event.StartTime.Unix(), truncate(event.Name, 60))
+	}
+	if len(events) > maxPreviewEvents {
+		fmt.Fprintf(&b, "and %d more", len(events)-maxPreviewEvents)
+	}
+	field.Value = truncate(b.String(), maxFieldValueLength)
+	return field
+}
+
+// runApplyFilter carries out a confirmed filter preview and replaces the
+// preview with a summary of what changed.
+func runApplyFilter(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, p c.FilterPreview) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredMessageUpdate,
+	})
+	if err != nil {
+		slog.Default().Error("error acknowledging filter apply", slog.Any("error", err))
+	}
+	var content string
+	ctx, cancel := deferredContext(i)
+	defer cancel()
+	result, err := cmd.ApplyFilter(ctx, p, i)
+	if err != nil {
+		slog.Default().Error("error applying filter", slog.String("url", p.URL), slog.String("expression", p.Filter.Expr.String()), slog.Any("error", err))
+		content = fmt.Sprintf("Error applying filter after removing %d and adding %d events: %s", len(result.Removed), len(result.Added), err)
+	} else {
+		content = fmt.Sprintf("Added %s filter: removed %d events and added %d events.", describeFilter(p.Filter), len(result.Removed), len(result.Added))
+	}
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content:    &content,
+		Embeds:     &[]*discordgo.MessageEmbed{},
+		Components: &[]discordgo.MessageComponent{},
+	})
+	if err != nil {
+		slog.Default().Error("error editing response to filter apply", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// rewriteHandlers handle the subcommands of the /calendar rewrite group
+var rewriteHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+	"add": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		// Editing the imported events can take longer than Discord waits for a response
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to rewrite add command", slog.Any("error", err))
+		}
+		var content string
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		rule, result, err := cmd.AddRewriteRule(ctx, url, stringOption(options, "field"), stringOption(options, "action"), stringOption(options, "pattern"), stringOption(options, "text"), i)
+		switch {
+		case err != nil && rule.ID == 0:
+			content = "Error adding rewrite rule: " + err.Error()
+		case err != nil:
+			content = fmt.Sprintf("Added rewrite rule `#%d` but failed to update the calendar's events after updating %d: %s", rule.ID, len(result.Updated), err)
+		default:
+			content = fmt.Sprintf("Added rewrite rule `#%d` (%s) and updated %d events.", rule.ID, rule, len(result.Updated))
+		}
+		if err != nil {
+			slog.Default().Error("error adding rewrite rule", slog.String("url", url), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to rewrite add command", slog.Any("error", err))
+		}
+	},
+	"list": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		var content string
+		ctx, cancel := responseContext(i)
+		defer cancel()
+		rules, err := cmd.RewriteRules(ctx, i.GuildID, stringOption(options, "url"))
+		switch {
+		case err != nil:
+			content = "Error finding calendar: " + err.Error()
+		case len(rules) == 0:
+			content = "This calendar has no rewrite rules."
+		default:
+			var b strings.Builder
+			b.WriteString("Rewrite rules, applied in order:")
+			for _, r := range rules {
+				fmt.Fprintf(&b, "\n`#%d` %s", r.ID, r)
+			}
+			content = b.String()
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: content,
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to rewrite list command", slog.Any("error", err))
+		}
+	},
+	"remove": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		id := options["id"].IntValue()
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to rewrite remove command", slog.Any("error", err))
+		}
+		var content string
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		rule, result, err := cmd.RemoveRewriteRule(ctx, url, id, i)
+		switch {
+		case errors.Is(err, store.ErrRewriteRuleNotFound):
+			content = fmt.Sprintf("Rewrite rule `#%d` does not exist, see `/calendar rewrite list`", id)
+		case err != nil && rule.ID == 0:
+			content = "Error removing rewrite rule: " + err.Error()
+		case err != nil:
+			content = fmt.Sprintf("Removed rewrite rule `#%d` but failed to update the calendar's events after updating %d: %s", id, len(result.Updated), err)
+		default:
+			content = fmt.Sprintf("Removed rewrite rule `#%d` (%s) and updated %d events.", id, rule, len(result.Updated))
+		}
+		if err != nil {
+			slog.Default().Error("error removing rewrite rule", slog.String("url", url), slog.Int64("id", id), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to rewrite remove command", slog.Any("error", err))
+		}
+	},
+}
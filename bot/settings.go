@@ -0,0 +1,171 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// clearSetting is typed into a text setting to reset it
+const clearSetting = "-"
+
+// settingsHandlers handle the subcommands of the /calendar settings group
+var settingsHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions){
+	"show": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		data := &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
+		ctx, cancel := responseContext(i)
+		defer cancel()
+		cal, err := cmd.Calendar(ctx, i.GuildID, stringOption(options, "url"))
+		if err != nil {
+			data.Content = "Error finding calendar: " + err.Error()
+		} else {
+			data.Embeds = []*discordgo.MessageEmbed{settingsEmbed(cal)}
+		}
+		err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: data,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to settings show command", slog.Any("error", err))
+		}
+	},
+	"set": func(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, options filterOptions) {
+		url := stringOption(options, "url")
+		// Applying the settings resyncs the calendar, which can take longer than
+		// Discord waits for a response
+		err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		})
+		if err != nil {
+			slog.Default().Error("error sending response to settings set command", slog.Any("error", err))
+		}
+		ctx, cancel := deferredContext(i)
+		defer cancel()
+		var content string
+		settings, err := cmd.Settings(ctx, i.GuildID, url)
+		if err == nil {
+			err = applySettingOptions(&settings, options)
+		}
+		var result c.SyncResult
+		if err == nil {
+			result, err = cmd.SetSettings(ctx, settings, i)
+		}
+		switch {
+		case err != nil && settings.URL == "":
+			content = "Error finding calendar: " + err.Error()
+		case err != nil:
+			content = "Error updating settings: " + err.Error()
+		default:
+			content = fmt.Sprintf("Updated settings, updated %d and added %d events.", len(result.Updated), len(result.Added))
+		}
+		if err != nil {
+			slog.Default().Error("error updating calendar settings", slog.String("url", url), slog.Any("error", err))
+		}
+		_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+			Content: &content,
+		})
+		if err != nil {
+			slog.Default().Error("error editing response to settings set command", slog.Any("error", err))
+		}
+	},
+}
+
+// applySettingOptions updates the settings given as options, leaving the rest
+// as they were. Text settings are reset by setting them to clearSetting.
+func applySettingOptions(settings *store.CalendarSettings, options filterOptions) error {
+	text := func(name string, setting *string) {
+		if opt, ok := options[name]; ok {
+			*setting = strings.TrimSpace(opt.StringValue())
+			if *setting == clearSetting {
+				*setting = ""
+			}
+		}
+	}
+	text("display_name", &settings.DisplayName)
+	text("emoji", &settings.Emoji)
+	text("default_location", &settings.DefaultLocation)
+	if opt, ok := options["color"]; ok {
+		color, err := parseColor(opt.StringValue())
+		if err != nil {
+			return err
+		}
+		settings.Color = color
+	}
+	if opt, ok := options["privacy"]; ok {
+		settings.PrivacyLevel = opt.StringValue()
+	}
+	if opt, ok := options["default_duration"]; ok {
+		d, err := time.ParseDuration(opt.StringValue())
+		if err != nil {
+			return fmt.Errorf("invalid default duration %q, expected e.g. 90m or 1h30m", opt.StringValue())
+		}
+		settings.DefaultDuration = d
+	}
+	if opt, ok := options["announcement_channel"]; ok {
+		settings.AnnouncementChannelID, _ = opt.Value.(string)
+	}
+	if opt, ok := options["no_announcements"]; ok && opt.BoolValue() {
+		settings.AnnouncementChannelID = ""
+	}
+	if opt, ok := options["horizon_days"]; ok {
+		settings.HorizonDays = int(opt.IntValue())
+	}
+	return nil
+}
+
+// parseColor parses a hex RGB color like #5865F2, or clearSetting for the
+// default color
+func parseColor(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == clearSetting {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return 0, fmt.Errorf("invalid color %q, expected a hex RGB color like #5865F2", s)
+	}
+	return int(n), nil
+}
+
+func settingsEmbed(cal store.Calendar) *discordgo.MessageEmbed {
+	cs := cal.Settings
+	orNone := func(s string) string {
+		if s == "" {
+			return "none"
+		}
+		return s
+	}
+	announcements := "none"
+	if cs.AnnouncementChannelID != "" {
+		announcements = "<#" + cs.AnnouncementChannelID + ">"
+	}
+	horizon := "no limit"
+	if cs.HorizonDays > 0 {
+		horizon = fmt.Sprintf("%d days", cs.HorizonDays)
+	}
+	color := "default"
+	if cs.Color != 0 {
+		color = fmt.Sprintf("#%06X", cs.Color)
+	}
+	return &discordgo.MessageEmbed{
+		Title:       "Settings for " + truncate(cal.DisplayName(), 200),
+		Description: cal.URL,
+		Color:       cs.Color,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Display name", Value: orNone(cs.DisplayName), Inline: true},
+			{Name: "Color", Value: color, Inline: true},
+			{Name: "Emoji", Value: orNone(cs.Emoji), Inline: true},
+			{Name: "Privacy", Value: cs.PrivacyLevel, Inline: true},
+			{Name: "Default duration", Value: cs.DefaultDuration.String(), Inline: true},
+			{Name: "Default location", Value: orNone(cs.DefaultLocation), Inline: true},
+			{Name: "Announcements", Value: announcements, Inline: true},
+			{Name: "Horizon", Value: horizon, Inline: true},
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package bot
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	c "git.phlcode.club/discord-bot/calendar"
+	"git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxModalFilters caps how many filters can be entered at once, each one is
+// evaluated against every event on every sync
+const maxModalFilters = 20
+
+// subscribeFilterModal asks for the include and exclude filters to subscribe
+// with, one expression per line, prefilled with the filter given as command
+// options if any.
+func subscribeFilterModal(key string, initial *store.Filter) *discordgo.InteractionResponseData {
+	var include, exclude string
+	if initial != nil {
+		if initial.Mode == store.FilterModeExclude {
+			exclude = initial.Expr.String()
+		} else {
+			include = initial.Expr.String()
+		}
+	}
+	return &discordgo.InteractionResponseData{
+		CustomID: "subscribe:" + key,
+		Title:    "Subscribe with filters",
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:    store.FilterModeInclude,
+						Label:       "Include filters, one per line",
+						Style:       discordgo.TextInputParagraph,
+						Placeholder: `name contains "Workshop"`,
+						Value:       include,
+					},
+				},
+			},
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:    store.FilterModeExclude,
+						Label:       "Exclude filters, one per line",
+						Style:       discordgo.TextInputParagraph,
+						Placeholder: `status = CANCELLED`,
+						Value:       exclude,
+					},
+				},
+			},
+		},
+	}
+}
+
+// modalFilters parses the filters entered into the subscribe modal
+func modalFilters(url string, data discordgo.ModalSubmitInteractionData, ignoreCase bool) (store.Filters, error) {
+	filters := make(store.Filters, 0)
+	for _, row := range data.Components {
+		row, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, component := range row.Components {
+			input, ok := component.(*discordgo.TextInput)
+			if !ok {
+				continue
+			}
+			for n, line := range strings.Split(input.Value, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" {
+					continue
+				}
+				filter, err := store.NewFilter(url, input.CustomID, line, ignoreCase)
+				if err != nil {
+					return nil, fmt.Errorf("%s filter on line %d: %w", input.CustomID, n+1, err)
+				}
+				filters = append(filters, *filter)
+			}
+		}
+	}
+	if len(filters) > maxModalFilters {
+		return nil, fmt.Errorf("at most %d filters can be added at once", maxModalFilters)
+	}
+	return filters, nil
+}
+
+// runSubscribe subscribes to the calendar, reporting errors in the response
+// Subscribe has already deferred.
+func runSubscribe(s *discordgo.Session, i *discordgo.InteractionCreate, cmd c.Commands, url string, filters store.Filters) {
+	ctx, cancel := deferredContext(i)
+	defer cancel()
+	err := cmd.Subscribe(ctx, url, i, filters)
+	if err == nil {
+		return
+	}
+	slog.Default().Error("error subscribing to calendar", slog.String("url", url), slog.Any("error", err))
+	content := "Error subscribing to calendar: " + err.Error()
+	_, err = s.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+		Content: &content,
+	})
+	if err != nil {
+		slog.Default().Error("error editing response to subscribe command", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,62 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// AdoptCalendars assigns calendars subscribed before calendars belonged to a
+// guild, which were migrated with no guild, to the guild their imported
+// events' scheduled events are in. When none of them are left on Discord and
+// the bot is only in one guild the calendar goes to that guild, otherwise it
+// is logged along with how to assign it by hand.
+func (c Cal) AdoptCalendars(ctx context.Context, guildIDs []string) error {
+	orphans, err := c.s.GetCalendars(ctx, "")
+	if err != nil || len(orphans) == 0 {
+		return err
+	}
+	guildOf := make(map[string]string)
+	for _, guildID := range guildIDs {
+		scheduled, err := c.session.GuildScheduledEvents(guildID, false, discordgo.WithContext(ctx))
+		if err != nil {
+			return fmt.Errorf("unable to list discord guild scheduled events: %w", err)
+		}
+		for _, event := range scheduled {
+			guildOf[event.ID] = guildID
+		}
+	}
+	var errs []error
+	for _, cal := range orphans {
+		events, err := c.s.GetEventsForURL(ctx, cal.URL)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var guildID string
+		for _, event := range events {
+			if id, ok := guildOf[event.ID]; ok {
+				guildID = id
+				break
+			}
+		}
+		if guildID == "" && len(guildIDs) == 1 {
+			guildID = guildIDs[0]
+		}
+		if guildID == "" {
+			c.logger.Error("unable to tell which guild a calendar subscribed before guilds belongs to, set it with: UPDATE calendars SET guild_id = '<guild id>' WHERE url = '<url>';",
+				slog.String("url", cal.URL))
+			continue
+		}
+		err = c.s.SetCalendarGuild(ctx, cal.URL, guildID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.logger.Info("assigned calendar subscribed before guilds to a guild", slog.String("url", cal.URL), slog.String("guildID", guildID))
+	}
+	return errors.Join(errs...)
+}
@@ -1,14 +1,43 @@
 package calendar
 
 import (
+	"context"
+	"time"
+
 	e "git.phlcode.club/discord-bot/events"
 	"git.phlcode.club/discord-bot/store"
 	"github.com/bwmarrin/discordgo"
 )
 
 type Commands interface {
-	Subscribe(url string, i *discordgo.InteractionCreate, filter *store.Filter) error
-	Unsubscribe(url string, i *discordgo.InteractionCreate) error
-	Filter(url, field, pattern string, i *discordgo.InteractionCreate) error
-	Events(url string) ([]e.Event, error)
+	Subscribe(ctx context.Context, url string, i *discordgo.InteractionCreate, filters store.Filters) error
+	Unsubscribe(ctx context.Context, url string, i *discordgo.InteractionCreate) (UnsubscribeResult, error)
+	Filter(ctx context.Context, url, mode, expression string, ignoreCase bool, i *discordgo.InteractionCreate) (SyncResult, error)
+	PreviewFilter(ctx context.Context, url, mode, expression string, ignoreCase bool, i *discordgo.InteractionCreate) (FilterPreview, error)
+	ApplyFilter(ctx context.Context, preview FilterPreview, i *discordgo.InteractionCreate) (SyncResult, error)
+	RemoveFilter(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (store.Filter, SyncResult, error)
+	Events(ctx context.Context, guildID, url string, from, to time.Time) ([]e.Event, error)
+	Calendars(ctx context.Context, guildID string) ([]store.Calendar, error)
+	Calendar(ctx context.Context, guildID, url string) (store.Calendar, error)
+	RewriteRules(ctx context.Context, guildID, url string) (store.RewriteRules, error)
+	AddRewriteRule(ctx context.Context, url, field, action, pattern, text string, i *discordgo.InteractionCreate) (store.RewriteRule, SyncResult, error)
+	RemoveRewriteRule(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (store.RewriteRule, SyncResult, error)
+	ChannelRules(ctx context.Context, guildID, url string) (store.ChannelRules, error)
+	AddChannelRule(ctx context.Context, url, patternType, pattern, channelID string, i *discordgo.InteractionCreate) (store.ChannelRule, SyncResult, error)
+	RemoveChannelRule(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (store.ChannelRule, SyncResult, error)
+	SetCover(ctx context.Context, guildID, url, imageURL string) error
+	Settings(ctx context.Context, guildID, url string) (store.CalendarSettings, error)
+	SetSettings(ctx context.Context, settings store.CalendarSettings, i *discordgo.InteractionCreate) (SyncResult, error)
+	Timezone(ctx context.Context, guildID string) (*time.Location, error)
+	SetTimezone(ctx context.Context, guildID, name string) (*time.Location, error)
+	// ScheduledEventDeleted and ScheduledEventUpdated reconcile changes made
+	// by hand on Discord to imported events
+	ScheduledEventDeleted(ctx context.Context, deleted *discordgo.GuildScheduledEvent) error
+	ScheduledEventUpdated(ctx context.Context, updated *discordgo.GuildScheduledEvent) error
+	// Poll resyncs every calendar with its remote calendar periodically until
+	// ctx is done
+	Poll(ctx context.Context)
+	// AdoptCalendars assigns calendars subscribed before calendars belonged
+	// to a guild to one of the guilds the bot is in
+	AdoptCalendars(ctx context.Context, guildIDs []string) error
 }
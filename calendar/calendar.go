@@ -1,10 +1,10 @@
 package calendar
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
-	"regexp"
 	"time"
 
 	e "git.phlcode.club/discord-bot/events"
@@ -15,181 +15,299 @@ import (
 
 type Cal struct {
 	logger  slog.Logger
-	session *discordgo.Session
+	session Discord
 	s       s.Store
+	q       *Queue
 }
 
-func NewCalendarCommands(logger slog.Logger, s s.Store, session *discordgo.Session) Commands {
+func NewCalendarCommands(logger slog.Logger, s s.Store, session Discord, q *Queue) Commands {
 	return Cal{
 		logger:  logger,
 		s:       s,
 		session: session,
+		q:       q,
 	}
 }
 
 // Events implements Commands.
-func (c Cal) Events(url string) ([]e.Event, error) {
-	return c.s.GetEventsForURL(url)
+func (c Cal) Events(ctx context.Context, guildID, url string, from, to time.Time) ([]e.Event, error) {
+	return c.s.GetEventsInRange(ctx, guildID, url, from, to)
 }
 
-func (c Cal) Subscribe(url string, i *discordgo.InteractionCreate, filter *s.Filter) error {
+// Calendars implements Commands.
+func (c Cal) Calendars(ctx context.Context, guildID string) ([]s.Calendar, error) {
+	return c.s.GetCalendars(ctx, guildID)
+}
+
+// Calendar implements Commands.
+func (c Cal) Calendar(ctx context.Context, guildID, url string) (s.Calendar, error) {
+	cal, err := c.s.GetCalendar(ctx, url)
+	if err != nil {
+		return s.Calendar{}, err
+	}
+	if cal.GuildID != guildID {
+		return s.Calendar{}, s.ErrCalendarNotFound
+	}
+	return cal, nil
+}
+
+// Timezone implements Commands.
+func (c Cal) Timezone(ctx context.Context, guildID string) (*time.Location, error) {
+	return c.s.GetGuildTimezone(ctx, guildID)
+}
+
+// SetTimezone implements Commands.
+func (c Cal) SetTimezone(ctx context.Context, guildID, name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" || name == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q, expected an IANA name like America/New_York", name)
+	}
+	return loc, c.s.SetGuildTimezone(ctx, guildID, loc)
+}
+
+// calendarName returns the X-WR-CALNAME of the remote calendar if it has one
+func calendarName(cal *ics.Calendar) string {
+	for _, prop := range cal.CalendarProperties {
+		if prop.IANAToken == string(ics.PropertyXWRCalName) {
+			return prop.Value
+		}
+	}
+	return ""
+}
+
+// Subscribe stores the calendar and its filters and queues its events that
+// pass the filters to be created on Discord, all in one transaction, then
+// waits for the queue to create them. If Discord refuses every one of them
+// the subscription is undone, so nothing is left half subscribed and it can
+// be retried. Events it refuses while creating others are reported and, as
+// they aren't recorded as imported, created by the calendar's next resync.
+func (c Cal) Subscribe(ctx context.Context, url string, i *discordgo.InteractionCreate, filters s.Filters) error {
 	content := "Subscribing to calendar at: " + url
 	err := c.session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
 			Content: content,
 		},
-	})
+	}, discordgo.WithContext(ctx))
 	if err != nil {
 		slog.Default().Error("error sending response to subscribe command", slog.Any("error", err))
 	}
-	cal, err := ics.ParseCalendarFromUrl(url)
+	err = checkNotSubscribed(ctx, c.s, i.GuildID, url)
+	if err != nil {
+		return err
+	}
+	cal, fetched, err := c.fetchCalendar(ctx, url)
+	if err != nil {
+		return err
+	}
+	fetched, err = prepareEvents(ctx, c.s, url, fetched)
 	if err != nil {
-		return errors.Join(errors.New("unable to fetch and parse remote ics"), err)
+		return err
 	}
 	content += "\nParsed calendar"
 	_, err = c.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 		Content: &content,
-	})
+	}, discordgo.WithContext(ctx))
 	if err != nil {
 		slog.Default().Error("error editing response to subscribe command", slog.Any("error", err))
 	}
 
-	_, err = c.s.InsertURL(url)
+	loc, err := c.s.GetGuildTimezone(ctx, i.GuildID)
 	if err != nil {
-		return fmt.Errorf("error inserting calendar into database: %w", err)
+		return err
 	}
-
-	content += "\nParsing events..."
+	ops := make([]s.Op, 0, len(fetched))
+	for _, currEvent := range fetched {
+		if c.shouldImport(currEvent, filters, loc) {
+			ops = append(ops, s.Op{Kind: s.OpCreate, Event: currEvent})
+		}
+	}
+	content += fmt.Sprintf("\nCreating %d events...", len(ops))
 	_, err = c.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 		Content: &content,
-	})
+	}, discordgo.WithContext(ctx))
 	if err != nil {
 		slog.Default().Error("error editing response to subscribe command", slog.Any("error", err))
 	}
-	events := make([]e.Event, 0, len(cal.Events()))
-	for _, event := range cal.Events() {
-		var currEvent e.Event
-		err := currEvent.ParseFromiCal(event)
-		if err != nil {
-			c.logger.Error("error parsing ical event", slog.Any("event", event), slog.Any("error", err))
-			continue
-		}
-
-		// Skip creating if it should be filtered
-		if filter != nil && !filter.Filter(currEvent) {
-			c.logger.Debug("filtered event", slog.String("pattern", filter.Pattern.String()), slog.String("name", currEvent.Name))
-			continue
-		}
-
-		// Skip creating if it is in the past
-		if currEvent.StartTime.Before(time.Now()) {
-			c.logger.Debug("past event", slog.String("name", currEvent.Name), slog.String("startTime", currEvent.StartTime.Format("2006-1-2 3:04PM")))
-			continue
-		}
 
-		event, err := c.session.GuildScheduledEventCreate(i.GuildID, &discordgo.GuildScheduledEventParams{
-			Name:               currEvent.Name,
-			Description:        currEvent.Description,
-			ScheduledStartTime: &currEvent.StartTime,
-			ScheduledEndTime:   &currEvent.EndTime,
-			Status:             discordgo.GuildScheduledEventStatusScheduled,
-			EntityType:         discordgo.GuildScheduledEventEntityTypeExternal,
-			EntityMetadata: &discordgo.GuildScheduledEventEntityMetadata{
-				Location: currEvent.Location,
-			},
-			PrivacyLevel: discordgo.GuildScheduledEventPrivacyLevelGuildOnly,
-		})
+	result, err := c.q.run(ctx, newBatch(s.BatchSync, i.GuildID, url, i), func(ctx context.Context, tx s.Store) ([]s.Op, error) {
+		// It may have been subscribed to while the feed was fetched
+		err := checkNotSubscribed(ctx, tx, i.GuildID, url)
 		if err != nil {
-			return fmt.Errorf("error creating discord guild scheduled event: %w", err)
+			return nil, err
 		}
-
-		currEvent.ID = event.ID
-
-		_, err = c.s.InsertEvent(url, currEvent)
+		_, err = tx.InsertCalendar(ctx, url, i.GuildID, calendarName(cal), filters)
 		if err != nil {
-			return fmt.Errorf("error inserting event into database: %w", err)
+			return nil, fmt.Errorf("error inserting calendar into database: %w", err)
 		}
-
-		events = append(events, currEvent)
-		content += "\nAdded event " + currEvent.Name
-		_, err = c.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
-			Content: &content,
-		})
-		if err != nil {
-			slog.Default().Error("error editing response to subscribe command", slog.Any("error", err))
+		return ops, nil
+	})
+	if len(ops) > 0 && len(result.Failed) == len(ops) {
+		undoErr := c.s.DeleteCalendar(ctx, url)
+		if undoErr != nil {
+			return errors.Join(err, fmt.Errorf("unable to undo subscription: %w", undoErr))
 		}
+		return fmt.Errorf("discord refused every event, so the calendar was not subscribed to: %w", err)
+	}
+	if err != nil && len(result.Added) == 0 {
+		return err
+	}
+	msg := fmt.Sprintf("subscribed to calendar at url %s with %d events...", url, len(result.Added))
+	if err != nil {
+		msg = fmt.Sprintf("subscribed to calendar at url %s with %d events, but %s\nThe rest are created when the calendar next syncs.", url, len(result.Added), err)
 	}
-
-	msg := fmt.Sprintf("subscribed to calendar at url %s with %d events...", url, len(events))
 	content += "\n" + msg
-	_, err = c.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
+	_, editErr := c.session.InteractionResponseEdit(i.Interaction, &discordgo.WebhookEdit{
 		Content: &content,
-	})
-	slog.Info(msg, slog.String("url", url), slog.Any("events", events))
-	return err
+	}, discordgo.WithContext(ctx))
+	slog.Info(msg, slog.String("url", url), slog.Any("events", result.Added))
+	if err != nil {
+		return err
+	}
+	return editErr
 }
 
-func (c Cal) Unsubscribe(url string, i *discordgo.InteractionCreate) error {
-	// TODO: This should really be a transaction
-	ids, err := c.s.DeleteEventsByURL(url)
+// errSubscribedElsewhere is returned for calendars another guild subscribes
+// to, without saying so since which calendars other guilds use is none of the
+// guild's business
+var errSubscribedElsewhere = errors.New("unable to subscribe to this calendar")
+
+// checkNotSubscribed returns an error if the guild, or any other, already
+// subscribes to the calendar
+func checkNotSubscribed(ctx context.Context, st s.Store, guildID, url string) error {
+	cal, err := st.GetCalendar(ctx, url)
+	switch {
+	case errors.Is(err, s.ErrCalendarNotFound):
+		return nil
+	case err != nil:
+		return err
+	case cal.GuildID == guildID:
+		return fmt.Errorf("already subscribed to calendar at %s", url)
+	}
+	return errSubscribedElsewhere
+}
+
+// UnsubscribeResult summarizes the Discord side of an unsubscribe
+type UnsubscribeResult struct {
+	// Removed is the number of scheduled events deleted from Discord
+	Removed int
+	// Failed holds the names of scheduled events Discord refused to delete
+	Failed []string
+}
+
+// Unsubscribe queues the calendar's scheduled events to be deleted from
+// Discord, going by the events stored when they are queued, and waits for the
+// queue to delete them. Once they are all deleted
+// the calendar, its events and its filters are removed from the database in
+// one transaction. If some Discord deletions fail only the events that were
+// actually deleted are removed from the database, keeping the calendar so
+// unsubscribing can be retried.
+func (c Cal) Unsubscribe(ctx context.Context, url string, i *discordgo.InteractionCreate) (UnsubscribeResult, error) {
+	var result UnsubscribeResult
+	_, err := c.Calendar(ctx, i.GuildID, url)
 	if err != nil {
-		return fmt.Errorf("error deleting events from database: %w", err)
+		return result, err
 	}
-	eventDeleteErrors := make([]error, 0)
-	for _, id := range ids {
-		err := c.session.GuildScheduledEventDelete(i.GuildID, id)
+	synced, err := c.q.run(ctx, newBatch(s.BatchUnsubscribe, i.GuildID, url, i), func(ctx context.Context, tx s.Store) ([]s.Op, error) {
+		err := tx.LockCalendar(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		events, err := tx.GetEventsForURL(ctx, url)
 		if err != nil {
-			eventDeleteErrors = append(eventDeleteErrors, err)
+			return nil, fmt.Errorf("error fetching events from database: %w", err)
+		}
+		ops := make([]s.Op, 0, len(events))
+		for _, event := range events {
+			if !event.ManuallyRemoved {
+				ops = append(ops, s.Op{Kind: s.OpDelete, Event: event})
+			}
 		}
+		return ops, nil
+	})
+	result.Removed = len(synced.Removed)
+	for _, event := range synced.Failed {
+		result.Failed = append(result.Failed, event.Name)
 	}
-	if len(eventDeleteErrors) > 0 {
-		return fmt.Errorf("error deleting events from discord: %+v", eventDeleteErrors)
+	return result, err
+}
+
+// isUnknownScheduledEvent reports whether err is Discord saying the event no
+// longer exists, e.g. because it was deleted by hand.
+func isUnknownScheduledEvent(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownGuildScheduledEvent
+}
+
+// RemoveFilter deletes the filter and resyncs the calendar so events it had
+// been excluding are imported and events it had been including are dropped.
+// The filter is deleted in the same transaction that queues the resync.
+func (c Cal) RemoveFilter(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (s.Filter, SyncResult, error) {
+	_, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return s.Filter{}, SyncResult{}, err
 	}
-	_, err = c.s.DeleteCalendarByURL(url)
+	var filter s.Filter
+	result, err := c.resync(ctx, i.GuildID, url, i, func(ctx context.Context, tx s.Store) error {
+		deleted, err := tx.DeleteFilter(ctx, url, id)
+		filter = deleted
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("error deleting calendar from database: %w", err)
+		return filter, result, err
 	}
-	return nil
+	c.logger.Info("removed filter", slog.String("url", url), slog.Int64("id", id), slog.Int("added", len(result.Added)), slog.Int("removed", len(result.Removed)))
+	return filter, result, nil
+}
+
+// FilterPreview is what adding a filter would do to a calendar's events
+type FilterPreview struct {
+	Filter s.Filter
+	SyncPlan
 }
 
-func (c Cal) Filter(url, field, pattern string, i *discordgo.InteractionCreate) error {
-	var f s.FilterField
-	switch field {
-	case s.FilterFieldName:
-		f = s.FilterFieldName
-	case s.FilterFieldDescription:
-		f = s.FilterFieldDescription
-	case s.FilterFieldLocation:
-		f = s.FilterFieldLocation
-	default:
-		return fmt.Errorf("invalid filter field: %s", field)
+// PreviewFilter evaluates the calendar's stored filters along with a new one
+// against both the imported and freshly fetched events, without changing
+// anything.
+func (c Cal) PreviewFilter(ctx context.Context, url, mode, expression string, ignoreCase bool, i *discordgo.InteractionCreate) (FilterPreview, error) {
+	cal, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return FilterPreview{}, err
 	}
-	regex, err := regexp.Compile(pattern)
+	filter, err := s.NewFilter(url, mode, expression, ignoreCase)
 	if err != nil {
-		return fmt.Errorf("invalid regex pattern: %s", err)
+		return FilterPreview{}, err
 	}
-	filter, err := c.s.CreateFilter(url, f, *regex)
+	_, fetched, err := c.fetchCalendar(ctx, url)
 	if err != nil {
-		return fmt.Errorf("unable to store filter: %s", err)
+		return FilterPreview{}, err
 	}
-	ids, err := c.s.GetEventsByPattern(filter)
+	plan, err := c.plan(ctx, c.s, i.GuildID, url, fetched, append(cal.Filters, *filter))
 	if err != nil {
-		return fmt.Errorf("unable to fetch events from db: %s", err)
+		return FilterPreview{}, err
 	}
-	eventDeleteErrors := make([]error, 0)
-	for _, id := range ids {
-		err := c.session.GuildScheduledEventDelete(i.GuildID, id)
+	return FilterPreview{Filter: *filter, SyncPlan: plan}, nil
+}
+
+// ApplyFilter stores the previewed filter and resyncs the calendar with it, in
+// the same transaction. The changes are worked out afresh rather than taken
+// from the preview, which may be out of date by the time it is confirmed.
+func (c Cal) ApplyFilter(ctx context.Context, preview FilterPreview, i *discordgo.InteractionCreate) (SyncResult, error) {
+	return c.resync(ctx, preview.GuildID, preview.URL, i, func(ctx context.Context, tx s.Store) error {
+		_, err := tx.CreateFilter(ctx, preview.Filter)
 		if err != nil {
-			eventDeleteErrors = append(eventDeleteErrors, err)
+			return fmt.Errorf("unable to store filter: %w", err)
 		}
-	}
-	if len(eventDeleteErrors) > 0 {
-		return fmt.Errorf("discord event delete errors: %+v", eventDeleteErrors)
-	}
-	err = c.s.DeleteEventsByIDs(ids)
+		return nil
+	})
+}
+
+// Filter stores a new filter for the calendar and resyncs it so the calendar's
+// events reflect the combined filters.
+func (c Cal) Filter(ctx context.Context, url, mode, expression string, ignoreCase bool, i *discordgo.InteractionCreate) (SyncResult, error) {
+	preview, err := c.PreviewFilter(ctx, url, mode, expression, ignoreCase, i)
 	if err != nil {
-		return fmt.Errorf("unable to delete events from db: %s", err)
+		return SyncResult{}, err
 	}
-	return err
+	return c.ApplyFilter(ctx, preview, i)
 }
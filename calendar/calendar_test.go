@@ -0,0 +1,703 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+const testGuildID = "guild"
+
+// feedEvent is an event served by a feed
+type feedEvent struct {
+	uid, name string
+	start     time.Time
+}
+
+// feed serves an iCal calendar whose events can be changed between fetches
+type feed struct {
+	mu     sync.Mutex
+	events []feedEvent
+	// broken makes fetches fail with a server error
+	broken bool
+}
+
+func (f *feed) set(events ...feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = events
+}
+
+func (f *feed) setBroken(broken bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broken = broken
+}
+
+func (f *feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+	const layout = "20060102T150405Z"
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nX-WR-CALNAME:Club\r\n")
+	for _, event := range f.events {
+		fmt.Fprintf(&b, "BEGIN:VEVENT\r\nUID:%s\r\nDTSTAMP:%s\r\nDTSTART:%s\r\nDTEND:%s\r\nSUMMARY:%s\r\nLOCATION:Room 1\r\nEND:VEVENT\r\n",
+			event.uid, event.start.UTC().Format(layout), event.start.UTC().Format(layout), event.start.Add(time.Hour).UTC().Format(layout), event.name)
+	}
+	b.WriteString("END:VCALENDAR\r\n")
+	w.Header().Set("Content-Type", "text/calendar")
+	io.WriteString(w, b.String())
+}
+
+// harness runs Cal against a feed, a FakeDiscord and an in-memory store with
+// the queue running in the background
+type harness struct {
+	ctx          context.Context
+	store        s.Store
+	discord      *FakeDiscord
+	cal          Cal
+	feed         *feed
+	url          string
+	interactions int
+}
+
+// upcoming are the events the feed starts with, along with one that already
+// took place and is never imported
+func upcoming() []feedEvent {
+	start := time.Now().Add(48 * time.Hour).Truncate(time.Hour)
+	return []feedEvent{
+		{"meetup", "Meetup", start},
+		{"workshop", "Workshop", start.Add(24 * time.Hour)},
+		{"social", "Social", start.Add(48 * time.Hour)},
+		{"past", "Past", start.Add(-96 * time.Hour)},
+	}
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &feed{}
+	f.set(upcoming()...)
+	server := httptest.NewServer(f)
+	t.Cleanup(func() {
+		cancel()
+		server.Close()
+	})
+	h := &harness{
+		ctx:     ctx,
+		store:   s.NewMemoryStore(),
+		discord: NewFakeDiscord(),
+		feed:    f,
+		url:     server.URL + "/club.ics",
+	}
+	h.cal = NewCalendarCommands(*testLogger, h.store, h.discord, h.startQueue(t)).(Cal)
+	return h
+}
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newQueue returns another instance's queue for the harness's store and
+// Discord, ready to run
+func (h *harness) newQueue(t *testing.T) *Queue {
+	t.Helper()
+	q := NewQueue(*testLogger, h.store, h.discord)
+	if err := q.Recover(h.ctx, h.discord.UserID); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// startQueue runs a new queue until the test is done
+func (h *harness) startQueue(t *testing.T) *Queue {
+	t.Helper()
+	q := h.newQueue(t)
+	ctx, cancel := context.WithCancel(h.ctx)
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return q
+}
+
+// interaction returns a new command interaction in the test guild
+func (h *harness) interaction() *discordgo.InteractionCreate {
+	h.interactions++
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:      strconv.Itoa(h.interactions),
+		AppID:   "app",
+		GuildID: testGuildID,
+		Token:   "token",
+	}}
+}
+
+func (h *harness) subscribe(t *testing.T) {
+	t.Helper()
+	if err := h.cal.Subscribe(h.ctx, h.url, h.interaction(), nil); err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+}
+
+// scheduled returns the fake's scheduled event with the name
+func (h *harness) scheduled(name string) *discordgo.GuildScheduledEvent {
+	h.discord.mu.Lock()
+	defer h.discord.mu.Unlock()
+	for _, event := range h.discord.Events {
+		if event.Name == name {
+			return event
+		}
+	}
+	return nil
+}
+
+// assertSynced checks that Discord has exactly the named scheduled events,
+// that the store has recorded each of them and no others, and that the queue
+// has nothing left to do
+func (h *harness) assertSynced(t *testing.T, names ...string) {
+	t.Helper()
+	slices.Sort(names)
+	h.discord.mu.Lock()
+	var scheduled []string
+	byID := make(map[string]string)
+	for _, event := range h.discord.Events {
+		scheduled = append(scheduled, event.Name)
+		byID[event.ID] = event.Name
+	}
+	h.discord.mu.Unlock()
+	slices.Sort(scheduled)
+	if !slices.Equal(scheduled, names) {
+		t.Errorf("discord has scheduled events %q, want %q", scheduled, names)
+	}
+	stored, err := h.store.GetEventsForURL(h.ctx, h.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []string
+	for _, event := range stored {
+		if event.ManuallyRemoved {
+			continue
+		}
+		recorded = append(recorded, event.Name)
+		if byID[event.ID] != event.Name {
+			t.Errorf("stored event %s has ID %s, which is %q on discord", event.Name, event.ID, byID[event.ID])
+		}
+	}
+	slices.Sort(recorded)
+	if !slices.Equal(recorded, names) {
+		t.Errorf("store has events %q, want %q", recorded, names)
+	}
+	batches, err := h.store.GetOpBatches(h.ctx)
+	if err != nil || len(batches) != 0 {
+		t.Errorf("queue still has batches %+v, %v", batches, err)
+	}
+}
+
+func eventNames(events []e.Event) []string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, event.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// forbidden is the error Discord returns for a request the bot lacks the
+// permissions for
+func forbidden() error {
+	return &discordgo.RESTError{
+		Response: &http.Response{StatusCode: http.StatusForbidden, Status: "403 Forbidden"},
+		Message:  &discordgo.APIErrorMessage{Code: discordgo.ErrCodeMissingPermissions, Message: "Missing Permissions"},
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := newHarness(t)
+	i := h.interaction()
+	if err := h.cal.Subscribe(h.ctx, h.url, i, nil); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 3 {
+		t.Errorf("created %d scheduled events, want 3", n)
+	}
+	cal, err := h.cal.Calendar(h.ctx, testGuildID, h.url)
+	if err != nil || cal.Name != "Club" {
+		t.Errorf("stored calendar %+v, %v", cal, err)
+	}
+	if response := h.discord.Responses[i.ID]; !strings.Contains(response, "with 3 events") {
+		t.Errorf("responded %q", response)
+	}
+	if err := h.cal.Subscribe(h.ctx, h.url, h.interaction(), nil); err == nil || !strings.Contains(err.Error(), "already subscribed") {
+		t.Errorf("subscribing to the same calendar twice: %v", err)
+	}
+
+	// Another guild isn't told this one subscribes to the calendar
+	other := h.interaction()
+	other.GuildID = "other"
+	err = h.cal.Subscribe(h.ctx, h.url, other, nil)
+	if !errors.Is(err, errSubscribedElsewhere) {
+		t.Errorf("subscribing from another guild: got %v, want errSubscribedElsewhere", err)
+	}
+	if cal, err := h.store.GetCalendar(h.ctx, h.url); err != nil || cal.GuildID != testGuildID {
+		t.Errorf("calendar stored as %+v, %v", cal, err)
+	}
+}
+
+func TestSubscribeRefused(t *testing.T) {
+	h := newHarness(t)
+	h.discord.Errors["GuildScheduledEventCreate"] = forbidden()
+	if err := h.cal.Subscribe(h.ctx, h.url, h.interaction(), nil); err == nil {
+		t.Fatal("subscribed although discord refused every event")
+	}
+	if _, err := h.store.GetCalendar(h.ctx, h.url); !errors.Is(err, s.ErrCalendarNotFound) {
+		t.Fatalf("refused subscription left the calendar stored: %v", err)
+	}
+	h.assertSynced(t)
+
+	delete(h.discord.Errors, "GuildScheduledEventCreate")
+	h.subscribe(t)
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+
+	// Events discord refuses once subscribed are created by the next resync
+	events := upcoming()
+	h.feed.set(append(events, feedEvent{"hackathon", "Hackathon", events[2].start.Add(24 * time.Hour)})...)
+	h.discord.Errors["GuildScheduledEventCreate"] = forbidden()
+	cal, err := h.store.GetCalendar(h.ctx, h.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := h.cal.poll(h.ctx, cal); err == nil || len(result.Failed) != 1 {
+		t.Fatalf("polling while discord refuses: %+v, %v", result, err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	delete(h.discord.Errors, "GuildScheduledEventCreate")
+	if result, err := h.cal.poll(h.ctx, cal); err != nil || len(result.Added) != 1 {
+		t.Fatalf("polling again: %+v, %v", result, err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social", "Hackathon")
+}
+
+func TestUnsubscribe(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+
+	h.discord.Errors["GuildScheduledEventDelete"] = forbidden()
+	result, err := h.cal.Unsubscribe(h.ctx, h.url, h.interaction())
+	if err == nil || len(result.Failed) != 3 {
+		t.Fatalf("unsubscribing without permission: %+v, %v", result, err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+
+	delete(h.discord.Errors, "GuildScheduledEventDelete")
+	result, err = h.cal.Unsubscribe(h.ctx, h.url, h.interaction())
+	if err != nil || result.Removed != 3 {
+		t.Fatalf("unsubscribing: %+v, %v", result, err)
+	}
+	h.assertSynced(t)
+	if _, err := h.store.GetCalendar(h.ctx, h.url); !errors.Is(err, s.ErrCalendarNotFound) {
+		t.Errorf("calendar still stored: %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+
+	result, err := h.cal.Filter(h.ctx, h.url, s.FilterModeExclude, "name contains social", true, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(result.Removed); !slices.Equal(got, []string{"Social"}) {
+		t.Errorf("filter removed %q", got)
+	}
+	h.assertSynced(t, "Meetup", "Workshop")
+
+	filters, err := h.store.GetFiltersForURL(h.ctx, h.url)
+	if err != nil || len(filters) != 1 {
+		t.Fatalf("stored filters %+v, %v", filters, err)
+	}
+	_, result, err = h.cal.RemoveFilter(h.ctx, h.url, filters[0].ID, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(result.Added); !slices.Equal(got, []string{"Social"}) {
+		t.Errorf("removing the filter added %q", got)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+}
+
+func TestPreviewFilter(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	calls := len(h.discord.Calls)
+
+	preview, err := h.cal.PreviewFilter(h.ctx, h.url, s.FilterModeInclude, `name = Workshop`, false, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(preview.Remove); !slices.Equal(got, []string{"Meetup", "Social"}) {
+		t.Errorf("preview removes %q", got)
+	}
+	if got := eventNames(preview.Keep); !slices.Equal(got, []string{"Workshop"}) {
+		t.Errorf("preview keeps %q", got)
+	}
+	if len(h.discord.Calls) != calls {
+		t.Errorf("previewing called discord: %+v", h.discord.Calls[calls:])
+	}
+	if filters, _ := h.store.GetFiltersForURL(h.ctx, h.url); len(filters) != 0 {
+		t.Errorf("previewing stored filters %+v", filters)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+
+	if _, err := h.cal.ApplyFilter(h.ctx, preview, h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Workshop")
+	if filters, _ := h.store.GetFiltersForURL(h.ctx, h.url); len(filters) != 1 {
+		t.Errorf("applying stored filters %+v", filters)
+	}
+}
+
+func TestApplyStaleFilterPreview(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	events := upcoming()
+	h.feed.set(append(events, feedEvent{"hackathon", "Hackathon", events[2].start.Add(24 * time.Hour)})...)
+
+	preview, err := h.cal.PreviewFilter(h.ctx, h.url, s.FilterModeExclude, `name = Social`, false, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := eventNames(preview.Add); !slices.Equal(got, []string{"Hackathon"}) {
+		t.Fatalf("preview adds %q", got)
+	}
+	// A poll imports the new event before the preview is confirmed
+	cal, err := h.store.GetCalendar(h.ctx, h.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.cal.poll(h.ctx, cal); err != nil {
+		t.Fatal(err)
+	}
+	result, err := h.cal.ApplyFilter(h.ctx, preview, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 {
+		t.Errorf("applying the preview added %q again", eventNames(result.Added))
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Hackathon")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 4 {
+		t.Errorf("created %d scheduled events, want 4", n)
+	}
+
+	preview, err = h.cal.PreviewFilter(h.ctx, h.url, s.FilterModeExclude, `name = Meetup`, false, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.cal.Unsubscribe(h.ctx, h.url, h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.cal.ApplyFilter(h.ctx, preview, h.interaction()); !errors.Is(err, s.ErrCalendarNotFound) {
+		t.Errorf("applying a preview after unsubscribing: got %v, want ErrCalendarNotFound", err)
+	}
+	h.assertSynced(t)
+	if filters, _ := h.store.GetFiltersForURL(h.ctx, h.url); len(filters) != 0 {
+		t.Errorf("applying a preview after unsubscribing stored filters %+v", filters)
+	}
+}
+
+func TestConcurrentPolls(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	events := upcoming()
+	h.feed.set(append(events, feedEvent{"hackathon", "Hackathon", events[2].start.Add(24 * time.Hour)})...)
+	cal, err := h.store.GetCalendar(h.ctx, h.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second poll plans while the first's create is still being made
+	h.discord.Delay = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			if _, err := h.cal.poll(h.ctx, cal); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	h.assertSynced(t, "Meetup", "Workshop", "Social", "Hackathon")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 4 {
+		t.Errorf("created %d scheduled events, want 4", n)
+	}
+}
+
+func TestRewriteRuleResync(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+
+	rule, result, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldName, s.RewritePrefix, "", "Club ", h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 3 || h.discord.CallCount("GuildScheduledEventEdit") != 3 {
+		t.Errorf("rewrite updated %q with %d edits", eventNames(result.Updated), h.discord.CallCount("GuildScheduledEventEdit"))
+	}
+	h.assertSynced(t, "Club Meetup", "Club Workshop", "Club Social")
+
+	if _, _, err := h.cal.RemoveRewriteRule(h.ctx, h.url, rule.ID, h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 3 {
+		t.Errorf("resyncs created %d more scheduled events", n-3)
+	}
+}
+
+func TestRewriteRuleFailedResync(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	rule, _, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldName, s.RewritePrefix, "", "Club ", h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.feed.setBroken(true)
+	if _, _, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldName, s.RewriteSuffix, "", "!", h.interaction()); err == nil {
+		t.Fatal("added a rewrite rule without fetching the calendar")
+	}
+	if _, _, err := h.cal.RemoveRewriteRule(h.ctx, h.url, rule.ID, h.interaction()); err == nil {
+		t.Fatal("removed a rewrite rule without fetching the calendar")
+	}
+	rules, err := h.store.GetRewriteRules(h.ctx, h.url)
+	if err != nil || len(rules) != 1 || rules[0].ID != rule.ID {
+		t.Errorf("failed resyncs left rewrite rules %+v, %v", rules, err)
+	}
+	h.assertSynced(t, "Club Meetup", "Club Workshop", "Club Social")
+}
+
+func TestChannelRuleResync(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	h.discord.Channels["voice"] = &discordgo.Channel{ID: "voice", GuildID: testGuildID, Type: discordgo.ChannelTypeGuildVoice}
+
+	rule, result, err := h.cal.AddChannelRule(h.ctx, h.url, s.PatternSubstring, "room 1", "voice", h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 3 || h.scheduled("Meetup").ChannelID != "voice" {
+		t.Fatalf("channel rule updated %q", eventNames(result.Updated))
+	}
+
+	h.feed.setBroken(true)
+	if _, _, err := h.cal.AddChannelRule(h.ctx, h.url, s.PatternSubstring, "room 2", "voice", h.interaction()); err == nil {
+		t.Fatal("added a channel rule without fetching the calendar")
+	}
+	if _, _, err := h.cal.RemoveChannelRule(h.ctx, h.url, rule.ID, h.interaction()); err == nil {
+		t.Fatal("removed a channel rule without fetching the calendar")
+	}
+	rules, err := h.store.GetChannelRules(h.ctx, h.url)
+	if err != nil || len(rules) != 1 || rules[0].ID != rule.ID {
+		t.Errorf("failed resyncs left channel rules %+v, %v", rules, err)
+	}
+
+	h.feed.setBroken(false)
+	if _, _, err := h.cal.RemoveChannelRule(h.ctx, h.url, rule.ID, h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	if meetup := h.scheduled("Meetup"); meetup.ChannelID != "" || meetup.EntityMetadata.Location != "Room 1" {
+		t.Errorf("removing the rule left Meetup in %q at %q", meetup.ChannelID, meetup.EntityMetadata.Location)
+	}
+}
+
+func TestSettingsResync(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	h.discord.Channels["news"] = &discordgo.Channel{ID: "news", GuildID: testGuildID, Type: discordgo.ChannelTypeGuildText}
+
+	settings := s.DefaultCalendarSettings(h.url)
+	settings.Emoji = "📅"
+	settings.AnnouncementChannelID = "news"
+	result, err := h.cal.SetSettings(h.ctx, settings, h.interaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Updated) != 3 {
+		t.Errorf("settings updated %q", eventNames(result.Updated))
+	}
+	h.assertSynced(t, "📅 Meetup", "📅 Workshop", "📅 Social")
+	if len(h.discord.Messages) != 0 {
+		t.Errorf("announced events that were only edited: %+v", h.discord.Messages)
+	}
+
+	settings.AnnouncementChannelID = "elsewhere"
+	if _, err := h.cal.SetSettings(h.ctx, settings, h.interaction()); err == nil {
+		t.Error("set an announcement channel discord doesn't know")
+	}
+
+	h.feed.setBroken(true)
+	changed := settings
+	changed.AnnouncementChannelID = "news"
+	changed.Emoji = "🎉"
+	if _, err := h.cal.SetSettings(h.ctx, changed, h.interaction()); err == nil {
+		t.Fatal("set settings without fetching the calendar")
+	}
+	if stored, err := h.store.GetCalendarSettings(h.ctx, h.url); err != nil || stored.Emoji != "📅" {
+		t.Errorf("failed resync left settings %+v, %v", stored, err)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	h.discord.Channels["news"] = &discordgo.Channel{ID: "news", GuildID: testGuildID, Type: discordgo.ChannelTypeGuildNews}
+	settings := s.DefaultCalendarSettings(h.url)
+	settings.AnnouncementChannelID = "news"
+	if _, err := h.cal.SetSettings(h.ctx, settings, h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+
+	events := upcoming()
+	moved := events[0].start.Add(2 * time.Hour)
+	events[0].start = moved
+	events[2] = feedEvent{"hackathon", "Hackathon", events[1].start.Add(72 * time.Hour)}
+	h.feed.set(events...)
+	h.cal.pollDue(h.ctx)
+
+	h.assertSynced(t, "Meetup", "Workshop", "Hackathon")
+	if meetup := h.scheduled("Meetup"); meetup == nil || !meetup.ScheduledStartTime.Equal(moved) {
+		t.Errorf("moved event is scheduled as %+v, want it to start at %s", meetup, moved)
+	}
+	if len(h.discord.Messages) != 1 || !strings.Contains(h.discord.Messages[0].Content, "Hackathon") {
+		t.Errorf("announced %+v, want the new event", h.discord.Messages)
+	}
+
+	calls := len(h.discord.Calls)
+	h.cal.pollDue(h.ctx)
+	if len(h.discord.Calls) != calls {
+		t.Errorf("polled a calendar that isn't due: %+v", h.discord.Calls[calls:])
+	}
+}
+
+func TestManualDeleteReconcile(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+
+	social := h.scheduled("Social")
+	if err := h.discord.GuildScheduledEventDelete(testGuildID, social.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.cal.ScheduledEventDeleted(h.ctx, social); err != nil {
+		t.Fatal(err)
+	}
+	_, stored, err := h.store.GetEvent(h.ctx, social.ID)
+	if err != nil || !stored.ManuallyRemoved {
+		t.Fatalf("event deleted by hand stored as %+v, %v", stored, err)
+	}
+
+	if _, _, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldName, s.RewriteSuffix, "", "!", h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup!", "Workshop!")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 3 {
+		t.Errorf("resync recreated the event deleted by hand")
+	}
+
+	result, err := h.cal.Unsubscribe(h.ctx, h.url, h.interaction())
+	if err != nil || result.Removed != 2 {
+		t.Fatalf("unsubscribing: %+v, %v", result, err)
+	}
+	if n := h.discord.CallCount("GuildScheduledEventDelete"); n != 3 {
+		t.Errorf("made %d deletes, want the 2 remaining events deleted after the one by hand", n)
+	}
+	h.assertSynced(t)
+}
+
+func TestManualEditReconcile(t *testing.T) {
+	h := newHarness(t)
+	h.subscribe(t)
+	// Discord changing the suffix's line ending isn't an edit
+	if _, _, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldDescription, s.RewriteSuffix, "", "Doors open at 6.\r\nSee you there!", h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	meetup := h.scheduled("Meetup")
+	if meetup.Description != "Doors open at 6.\nSee you there!" {
+		t.Fatalf("discord has description %q", meetup.Description)
+	}
+	if err := h.cal.ScheduledEventUpdated(h.ctx, meetup); err != nil {
+		t.Fatal(err)
+	}
+	if _, stored, err := h.store.GetEvent(h.ctx, meetup.ID); err != nil || len(stored.EditedFields) != 0 {
+		t.Fatalf("event Discord normalized stored as edited: %q, %v", stored.EditedFields, err)
+	}
+
+	// Neither is Discord having the truncated description of an event stored
+	// before descriptions were truncated
+	workshop := h.scheduled("Workshop")
+	url, stored, err := h.store.GetEvent(h.ctx, workshop.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Description = strings.Repeat("Lots of detail. ", 100)
+	if err := h.store.UpdateEvent(h.ctx, url, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.discord.GuildScheduledEventEdit(testGuildID, workshop.ID, &discordgo.GuildScheduledEventParams{Description: stored.ForDiscord().Description}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.cal.ScheduledEventUpdated(h.ctx, h.scheduled("Workshop")); err != nil {
+		t.Fatal(err)
+	}
+	if _, stored, err := h.store.GetEvent(h.ctx, workshop.ID); err != nil || len(stored.EditedFields) != 0 {
+		t.Fatalf("truncated event stored as edited: %q, %v", stored.EditedFields, err)
+	}
+
+	// An edit by hand is recorded and left alone by later syncs
+	location := "Room 2"
+	if _, err := h.discord.GuildScheduledEventEdit(testGuildID, meetup.ID, &discordgo.GuildScheduledEventParams{
+		EntityMetadata: &discordgo.GuildScheduledEventEntityMetadata{Location: location},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.cal.ScheduledEventUpdated(h.ctx, h.scheduled("Meetup")); err != nil {
+		t.Fatal(err)
+	}
+	if _, stored, err := h.store.GetEvent(h.ctx, meetup.ID); err != nil || !slices.Equal(stored.EditedFields, []string{e.FieldLocation}) {
+		t.Fatalf("event edited by hand stored with edited fields %q, %v", stored.EditedFields, err)
+	}
+	if _, _, err := h.cal.AddRewriteRule(h.ctx, h.url, s.RewriteFieldName, s.RewriteSuffix, "", "!", h.interaction()); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup!", "Workshop!", "Social!")
+	if got := h.scheduled("Meetup!").EntityMetadata.Location; got != location {
+		t.Errorf("resync changed the location edited by hand to %q", got)
+	}
+	if got := h.scheduled("Social!").EntityMetadata.Location; got != "Room 1" {
+		t.Errorf("resync left Social at %q", got)
+	}
+}
@@ -0,0 +1,91 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelEntityType returns the scheduled event entity type for hosting an
+// event in the guild's channel.
+func (c Cal) channelEntityType(ctx context.Context, guildID, channelID string) (discordgo.GuildScheduledEventEntityType, error) {
+	channel, err := c.session.Channel(channelID, discordgo.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("unable to find channel %s: %w", channelID, err)
+	}
+	if channel.GuildID != guildID {
+		return 0, permanentError{fmt.Errorf("channel %s is not in this server", channelID)}
+	}
+	switch channel.Type {
+	case discordgo.ChannelTypeGuildVoice:
+		return discordgo.GuildScheduledEventEntityTypeVoice, nil
+	case discordgo.ChannelTypeGuildStageVoice:
+		return discordgo.GuildScheduledEventEntityTypeStageInstance, nil
+	}
+	return 0, permanentError{fmt.Errorf("channel %s is not a voice or stage channel", channel.Name)}
+}
+
+// ChannelRules implements Commands.
+func (c Cal) ChannelRules(ctx context.Context, guildID, url string) (s.ChannelRules, error) {
+	_, err := c.Calendar(ctx, guildID, url)
+	if err != nil {
+		return nil, err
+	}
+	return c.s.GetChannelRules(ctx, url)
+}
+
+// AddChannelRule stores a rule hosting the calendar's events whose location
+// matches the pattern in a voice or stage channel, then resyncs the calendar
+// to move the matching imported events into it. The rule is stored in the
+// same transaction that queues the resync.
+func (c Cal) AddChannelRule(ctx context.Context, url, patternType, pattern, channelID string, i *discordgo.InteractionCreate) (s.ChannelRule, SyncResult, error) {
+	_, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return s.ChannelRule{}, SyncResult{}, err
+	}
+	rule, err := s.NewChannelRule(url, patternType, pattern, channelID)
+	if err != nil {
+		return s.ChannelRule{}, SyncResult{}, err
+	}
+	if _, err = c.channelEntityType(ctx, i.GuildID, channelID); err != nil {
+		return s.ChannelRule{}, SyncResult{}, err
+	}
+	var stored s.ChannelRule
+	result, err := c.resync(ctx, i.GuildID, url, i, func(ctx context.Context, tx s.Store) error {
+		created, err := tx.CreateChannelRule(ctx, *rule)
+		if err != nil {
+			return fmt.Errorf("unable to store channel rule: %w", err)
+		}
+		stored = created
+		return nil
+	})
+	if err != nil {
+		return stored, result, err
+	}
+	c.logger.Info("added channel rule", slog.String("url", url), slog.Int64("id", stored.ID), slog.Int("updated", len(result.Updated)))
+	return stored, result, nil
+}
+
+// RemoveChannelRule deletes the channel rule and resyncs the calendar so the
+// events it matched go back to their external location. The rule is deleted in
+// the same transaction that queues the resync.
+func (c Cal) RemoveChannelRule(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (s.ChannelRule, SyncResult, error) {
+	_, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return s.ChannelRule{}, SyncResult{}, err
+	}
+	var rule s.ChannelRule
+	result, err := c.resync(ctx, i.GuildID, url, i, func(ctx context.Context, tx s.Store) error {
+		deleted, err := tx.DeleteChannelRule(ctx, url, id)
+		rule = deleted
+		return err
+	})
+	if err != nil {
+		return rule, result, err
+	}
+	c.logger.Info("removed channel rule", slog.String("url", url), slog.Int64("id", id), slog.Int("updated", len(result.Updated)))
+	return rule, result, nil
+}
@@ -0,0 +1,38 @@
+package calendar
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Discord is the part of the Discord API Cal uses, so it can be run against
+// something other than a live session such as FakeDiscord.
+type Discord interface {
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	GuildScheduledEventCreate(guildID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error)
+	GuildScheduledEventEdit(guildID, eventID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error)
+	GuildScheduledEventDelete(guildID, eventID string, options ...discordgo.RequestOption) error
+	GuildScheduledEvents(guildID string, userCount bool, options ...discordgo.RequestOption) ([]*discordgo.GuildScheduledEvent, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	// Channel returns the channel, preferring a cached copy over asking
+	// Discord
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+}
+
+// sessionDiscord is a Discord backed by a live session
+type sessionDiscord struct {
+	*discordgo.Session
+}
+
+// NewDiscord returns the Discord for a live session
+func NewDiscord(session *discordgo.Session) Discord {
+	return sessionDiscord{session}
+}
+
+func (d sessionDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	channel, err := d.State.Channel(channelID)
+	if err == nil {
+		return channel, nil
+	}
+	return d.Session.Channel(channelID, options...)
+}
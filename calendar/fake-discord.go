@@ -0,0 +1,249 @@
+package calendar
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// FakeCall is a call made to a FakeDiscord
+type FakeCall struct {
+	Method string
+	// Args are the arguments the method was called with, without the request
+	// options
+	Args []any
+}
+
+// FakeDiscord is a Discord that keeps scheduled events in memory and records
+// every call made to it, for exercising Cal without a bot token.
+type FakeDiscord struct {
+	mu sync.Mutex
+	// Calls are the calls made so far, in order
+	Calls []FakeCall
+	// Events are the scheduled events that currently exist, by ID
+	Events map[string]*discordgo.GuildScheduledEvent
+	// Channels are the channels Channel knows about, by ID
+	Channels map[string]*discordgo.Channel
+	// Responses are the latest content of each interaction's response, by
+	// interaction ID
+	Responses map[string]string
+	// Messages are the messages sent to channels, in order
+	Messages []*discordgo.MessageSend
+	// Errors makes the method with the given name fail with the error
+	Errors map[string]error
+	// UserID is the bot's user ID, the creator of the events it creates
+	UserID string
+	// Delay is how long creating, editing or deleting a scheduled event
+	// takes, for overlapping concurrent callers. It must be set before use.
+	Delay  time.Duration
+	nextID int
+}
+
+func NewFakeDiscord() *FakeDiscord {
+	return &FakeDiscord{
+		UserID:    "bot",
+		Events:    make(map[string]*discordgo.GuildScheduledEvent),
+		Channels:  make(map[string]*discordgo.Channel),
+		Responses: make(map[string]string),
+		Errors:    make(map[string]error),
+	}
+}
+
+// record notes the call and returns the error it has been set up to fail
+// with, if any. The caller must hold mu.
+func (d *FakeDiscord) record(method string, args ...any) error {
+	d.Calls = append(d.Calls, FakeCall{Method: method, Args: args})
+	return d.Errors[method]
+}
+
+// CallCount returns how many times the method has been called
+func (d *FakeDiscord) CallCount(method string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, call := range d.Calls {
+		if call.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+// unknownScheduledEvent is the error Discord returns for an event that
+// doesn't exist
+func unknownScheduledEvent() error {
+	return &discordgo.RESTError{
+		Response:     &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found"},
+		ResponseBody: []byte(`{"message": "Unknown Guild Scheduled Event", "code": 10070}`),
+		Message: &discordgo.APIErrorMessage{
+			Code:    discordgo.ErrCodeUnknownGuildScheduledEvent,
+			Message: "Unknown Guild Scheduled Event",
+		},
+	}
+}
+
+func (d *FakeDiscord) InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("InteractionRespond", interaction, resp)
+	if err != nil {
+		return err
+	}
+	if resp.Data != nil {
+		d.Responses[interaction.ID] = resp.Data.Content
+	}
+	return nil
+}
+
+func (d *FakeDiscord) InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("InteractionResponseEdit", interaction, newresp)
+	if err != nil {
+		return nil, err
+	}
+	if newresp.Content != nil {
+		d.Responses[interaction.ID] = *newresp.Content
+	}
+	return &discordgo.Message{ChannelID: interaction.ChannelID, Content: d.Responses[interaction.ID]}, nil
+}
+
+func (d *FakeDiscord) GuildScheduledEventCreate(guildID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error) {
+	time.Sleep(d.Delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("GuildScheduledEventCreate", guildID, event)
+	if err != nil {
+		return nil, err
+	}
+	d.nextID++
+	created := &discordgo.GuildScheduledEvent{
+		ID:           strconv.Itoa(d.nextID),
+		GuildID:      guildID,
+		CreatorID:    d.UserID,
+		PrivacyLevel: event.PrivacyLevel,
+		Status:       discordgo.GuildScheduledEventStatusScheduled,
+	}
+	setScheduledEvent(created, event)
+	d.Events[created.ID] = created
+	return created, nil
+}
+
+func (d *FakeDiscord) GuildScheduledEventEdit(guildID, eventID string, event *discordgo.GuildScheduledEventParams, options ...discordgo.RequestOption) (*discordgo.GuildScheduledEvent, error) {
+	time.Sleep(d.Delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("GuildScheduledEventEdit", guildID, eventID, event)
+	if err != nil {
+		return nil, err
+	}
+	edited, ok := d.Events[eventID]
+	if !ok || edited.GuildID != guildID {
+		return nil, unknownScheduledEvent()
+	}
+	setScheduledEvent(edited, event)
+	return edited, nil
+}
+
+// setScheduledEvent copies the fields Cal sets from params to event. Like
+// Discord, fields params leaves empty are left as they are and text is stored
+// normalized.
+func setScheduledEvent(event *discordgo.GuildScheduledEvent, params *discordgo.GuildScheduledEventParams) {
+	if params.Name != "" {
+		event.Name = discordText(params.Name)
+	}
+	if params.Description != "" {
+		event.Description = discordText(params.Description)
+	}
+	if params.ScheduledStartTime != nil {
+		event.ScheduledStartTime = *params.ScheduledStartTime
+	}
+	if params.ScheduledEndTime != nil {
+		event.ScheduledEndTime = params.ScheduledEndTime
+	}
+	if params.EntityType != 0 {
+		event.EntityType = params.EntityType
+		event.ChannelID = params.ChannelID
+		event.EntityMetadata = discordgo.GuildScheduledEventEntityMetadata{}
+	}
+	if params.EntityMetadata != nil {
+		event.EntityMetadata = *params.EntityMetadata
+		event.EntityMetadata.Location = discordText(event.EntityMetadata.Location)
+	}
+	if params.Image != "" {
+		event.Image = params.Image
+	}
+}
+
+func (d *FakeDiscord) GuildScheduledEventDelete(guildID, eventID string, options ...discordgo.RequestOption) error {
+	time.Sleep(d.Delay)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("GuildScheduledEventDelete", guildID, eventID)
+	if err != nil {
+		return err
+	}
+	deleted, ok := d.Events[eventID]
+	if !ok || deleted.GuildID != guildID {
+		return unknownScheduledEvent()
+	}
+	delete(d.Events, eventID)
+	return nil
+}
+
+func (d *FakeDiscord) GuildScheduledEvents(guildID string, userCount bool, options ...discordgo.RequestOption) ([]*discordgo.GuildScheduledEvent, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("GuildScheduledEvents", guildID, userCount)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*discordgo.GuildScheduledEvent, 0)
+	for _, event := range d.Events {
+		if event.GuildID == guildID {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	// The IDs are handed out in order, like snowflakes
+	slices.SortFunc(events, func(a, b *discordgo.GuildScheduledEvent) int {
+		x, _ := strconv.Atoi(a.ID)
+		y, _ := strconv.Atoi(b.ID)
+		return cmp.Compare(x, y)
+	})
+	return events, nil
+}
+
+func (d *FakeDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("ChannelMessageSendComplex", channelID, data)
+	if err != nil {
+		return nil, err
+	}
+	d.Messages = append(d.Messages, data)
+	return &discordgo.Message{ChannelID: channelID, Content: data.Content}, nil
+}
+
+func (d *FakeDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.record("Channel", channelID)
+	if err != nil {
+		return nil, err
+	}
+	channel, ok := d.Channels[channelID]
+	if !ok {
+		return nil, &discordgo.RESTError{
+			Response:     &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found"},
+			ResponseBody: []byte(`{"message": "Unknown Channel", "code": 10003}`),
+			Message:      &discordgo.APIErrorMessage{Code: discordgo.ErrCodeUnknownChannel, Message: "Unknown Channel"},
+		}
+	}
+	return channel, nil
+}
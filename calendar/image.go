@@ -0,0 +1,150 @@
+package calendar
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+)
+
+const (
+	// maxImageSize keeps cover images well within what Discord accepts
+	maxImageSize = 4 << 20
+	imageTimeout = 15 * time.Second
+)
+
+// imageTypes are the formats Discord accepts for scheduled event covers
+var imageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// errNonPublicAddress is returned for image URLs that resolve to an address
+// on the bot's own machine or network
+var errNonPublicAddress = errors.New("image url must resolve to a public address")
+
+// sharedAddressSpace is the carrier-grade NAT range, which some clouds serve
+// instance metadata from
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// publicAddress reports whether addr is reachable on the internet, as opposed
+// to loopback, link-local, private and other special addresses
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// imageClient fetches images from URLs in third-party calendars, so it only
+// connects to public addresses, checked once they are resolved so DNS can't
+// point it elsewhere, and ignores proxies which would connect for it.
+var imageClient = &http.Client{
+	Timeout: imageTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: imageTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				addrPort, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddress(addrPort.Addr()) {
+					return errNonPublicAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: imageTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkImageURL(req.URL)
+	},
+}
+
+// checkImageURL rejects image URLs that aren't http or https
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("image url must be http or https, not %q", u.Scheme)
+	}
+	return nil
+}
+
+// fetchImage downloads the image at imageURL and returns it as a data URI,
+// the form Discord expects cover images in. The type is sniffed from the
+// content rather than trusted from the server.
+func fetchImage(ctx context.Context, imageURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid image url: %w", err)
+	}
+	err = checkImageURL(req.URL)
+	if err != nil {
+		return "", err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to download image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to download image: %s", resp.Status)
+	}
+	if resp.ContentLength > maxImageSize {
+		return "", fmt.Errorf("image is larger than %d MiB", maxImageSize>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return "", fmt.Errorf("unable to download image: %w", err)
+	}
+	if len(data) > maxImageSize {
+		return "", fmt.Errorf("image is larger than %d MiB", maxImageSize>>20)
+	}
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(imageTypes, contentType) {
+		return "", fmt.Errorf("unsupported image type %s, expected PNG, JPEG, GIF or WebP", contentType)
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// eventImage returns the cover image for event as a data URI, falling back to
+// the calendar's default cover when the event has no usable image of its own.
+func (c Cal) eventImage(ctx context.Context, url string, event e.Event) string {
+	if event.ImageURL != "" {
+		image, err := fetchImage(ctx, event.ImageURL)
+		if err == nil {
+			return image
+		}
+		c.logger.Warn("unable to use event image", slog.String("name", event.Name), slog.String("image", event.ImageURL), slog.Any("error", err))
+	}
+	cover, err := c.s.GetCalendarCover(ctx, url)
+	if err != nil {
+		c.logger.Warn("unable to get calendar cover", slog.String("url", url), slog.Any("error", err))
+		return ""
+	}
+	return cover
+}
+
+// SetCover downloads the image to use as the calendar's default cover, or
+// removes the default cover when imageURL is empty. It applies to events
+// created from then on and events whose own image changes.
+func (c Cal) SetCover(ctx context.Context, guildID, url, imageURL string) error {
+	_, err := c.Calendar(ctx, guildID, url)
+	if err != nil {
+		return err
+	}
+	var cover string
+	if imageURL != "" {
+		cover, err = fetchImage(ctx, imageURL)
+		if err != nil {
+			return err
+		}
+	}
+	return c.s.SetCalendarCover(ctx, url, cover)
+}
@@ -0,0 +1,65 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"0.0.0.0", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestFetchImageRejectsNonPublicURLs(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	for _, url := range []string{
+		server.URL + "/cover.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://localhost:1/cover.png",
+		"file:///etc/passwd",
+		"ftp://example.com/cover.png",
+	} {
+		if _, err := fetchImage(context.Background(), url); err == nil {
+			t.Errorf("fetched %s", url)
+		}
+	}
+	if _, err := fetchImage(context.Background(), server.URL); !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("fetching from loopback: got %v, want errNonPublicAddress", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("the loopback server got %d requests", n)
+	}
+}
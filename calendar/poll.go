@@ -0,0 +1,86 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	s "git.phlcode.club/discord-bot/store"
+)
+
+const (
+	// pollInterval is how often each calendar is resynced with its remote
+	// calendar without a command asking for it
+	pollInterval = time.Hour
+	// pollCheckInterval is how often calendars due a poll are looked for
+	pollCheckInterval = 5 * time.Minute
+	// pollTimeout bounds waiting for a poll's changes, which carry on in the
+	// queue after it
+	pollTimeout = 5 * time.Minute
+)
+
+// Poll resyncs each calendar every pollInterval until ctx is done, so events
+// added, changed or deleted at the source reach Discord, with the filters and
+// rewrite rules applied, without anyone running a command.
+func (c Cal) Poll(ctx context.Context) {
+	ticker := time.NewTicker(pollCheckInterval)
+	defer ticker.Stop()
+	for {
+		c.pollDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollDue resyncs the calendars due a poll. Calendars with changes still
+// queued are skipped until their next poll, as planning against events that
+// have not been recorded yet would queue them again.
+func (c Cal) pollDue(ctx context.Context) {
+	calendars, err := c.s.ClaimCalendarPolls(ctx, time.Now().Add(-pollInterval))
+	if err != nil {
+		c.logger.Error("unable to claim calendar polls", slog.Any("error", err))
+		return
+	}
+	if len(calendars) == 0 {
+		return
+	}
+	batches, err := c.s.GetOpBatches(ctx)
+	if err != nil {
+		c.logger.Error("unable to get queued op batches", slog.Any("error", err))
+		return
+	}
+	queued := make(map[string]bool, len(batches))
+	for _, batch := range batches {
+		queued[batch.URL] = true
+	}
+	for _, cal := range calendars {
+		if ctx.Err() != nil {
+			return
+		}
+		if queued[cal.URL] {
+			c.logger.Debug("not polling calendar with changes still queued", slog.String("url", cal.URL))
+			continue
+		}
+		result, err := c.poll(ctx, cal)
+		if err != nil && !errors.Is(err, ErrStillQueued) {
+			c.logger.Error("error polling calendar", slog.String("url", cal.URL), slog.Any("error", err))
+			continue
+		}
+		if len(result.Added)+len(result.Updated)+len(result.Removed) > 0 {
+			c.logger.Info("polled calendar", slog.String("url", cal.URL), slog.Int("added", len(result.Added)),
+				slog.Int("updated", len(result.Updated)), slog.Int("removed", len(result.Removed)))
+		}
+	}
+}
+
+// poll resyncs the calendar with its remote calendar and stored filters, rules
+// and settings
+func (c Cal) poll(ctx context.Context, cal s.Calendar) (SyncResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
+	return c.resync(ctx, cal.GuildID, cal.URL, nil, nil)
+}
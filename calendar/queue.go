@@ -0,0 +1,695 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// maxOpAttempts is how many times an op that keeps failing with a
+	// transient error is tried before giving up on it
+	maxOpAttempts = 5
+	// opRetryDelay is how long to wait before trying a failed op again, it
+	// doubles with every attempt up to maxOpRetryDelay
+	opRetryDelay    = 5 * time.Second
+	maxOpRetryDelay = 5 * time.Minute
+	// opTimeout bounds a single attempt at an op
+	opTimeout = 30 * time.Second
+	// opLease is how long an instance's claim on an op lasts, long enough to
+	// attempt it and record how it went
+	opLease = time.Minute
+	// batchCheckInterval is how often a command waiting for its batch checks
+	// whether another instance sharing the database made the batch's last op
+	batchCheckInterval = 2 * time.Second
+	// idleWait is how long the queue sleeps when nothing is due, it is woken
+	// sooner when ops are queued
+	idleWait = time.Hour
+	// interactionTokenLifetime is how long Discord accepts edits to an
+	// interaction's response
+	interactionTokenLifetime = 15 * time.Minute
+)
+
+// ErrStillQueued is returned when the command's deadline passed before the
+// queue finished making its changes. They carry on in the background and the
+// outcome is posted to the interaction once they finish.
+var ErrStillQueued = errors.New("discord is still working through the changes, the outcome will be posted here once they are done")
+
+// ErrFinishedElsewhere is returned when another instance sharing the database
+// finished the command's changes after the command stopped holding on to them.
+var ErrFinishedElsewhere = errors.New("another instance of the bot finished making the changes")
+
+// batchOutcome is what a finished batch did
+type batchOutcome struct {
+	result SyncResult
+	err    error
+}
+
+// Queue makes changes to guild scheduled events on Discord one at a time. The
+// changes are stored before they are made so they resume after a restart,
+// transient failures are retried with backoff and guilds Discord rate limits
+// are paused for as long as it asks. Instances sharing a database each claim
+// an op before making it, so every op is made by only one of them.
+type Queue struct {
+	c    Cal
+	wake chan struct{}
+	// work is held while making an op or recovering unrecorded ones
+	work sync.Mutex
+	// finishing is held while finishing a batch, so a batch this instance
+	// finishes is seen as gone only once its outcome has been delivered
+	finishing sync.Mutex
+
+	mu sync.Mutex
+	// userID is the bot's user ID, the creator of the events it creates
+	userID string
+	// waiters are the commands waiting for their batch to finish, by batch ID
+	waiters map[int64]chan batchOutcome
+	// handoffs holds the batches this instance made the last op of while a
+	// command on another instance waits for them, and until when it waits
+	handoffs map[int64]time.Time
+	// paused holds the guilds Discord has rate limited and until when
+	paused map[string]time.Time
+	// busy holds the scheduled events an op is being made to, so their
+	// gateway events can be told apart from changes made by hand
+	busy map[string]bool
+}
+
+func NewQueue(logger slog.Logger, store s.Store, session Discord) *Queue {
+	return &Queue{
+		c:        Cal{logger: logger, s: store, session: session},
+		wake:     make(chan struct{}, 1),
+		waiters:  make(map[int64]chan batchOutcome),
+		handoffs: make(map[int64]time.Time),
+		paused:   make(map[string]time.Time),
+		busy:     make(map[string]bool),
+	}
+}
+
+// newBatch returns the batch for changes made to the calendar by the
+// interaction, if there is one
+func newBatch(action s.BatchAction, guildID, url string, i *discordgo.InteractionCreate) s.OpBatch {
+	batch := s.OpBatch{Action: action, GuildID: guildID, URL: url}
+	if i != nil {
+		batch.ApplicationID = i.AppID
+		batch.InteractionID = i.ID
+		batch.InteractionToken = i.Token
+	}
+	return batch
+}
+
+// run stores the ops queue returns as a batch, in the transaction queue works
+// them out and makes any other changes in, and waits for the queue to finish
+// them. If ctx is done first
+// run returns ErrStillQueued and the outcome is reported to the batch's
+// interaction instead. Until ctx's deadline, or for as long as an interaction
+// lasts without one, the batch is left for this call to finish, which also
+// covers the queue making its ops before the waiter is registered.
+func (q *Queue) run(ctx context.Context, batch s.OpBatch, queue func(ctx context.Context, tx s.Store) ([]s.Op, error)) (SyncResult, error) {
+	awaited, ok := ctx.Deadline()
+	if !ok {
+		awaited = time.Now().Add(interactionTokenLifetime)
+	}
+	batch.AwaitedUntil = awaited
+	err := q.c.s.WithTx(ctx, func(tx s.Store) error {
+		ops, err := queue(ctx, tx)
+		if err != nil {
+			return err
+		}
+		batch, err = tx.QueueOps(ctx, batch, ops)
+		return err
+	})
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	done := make(chan batchOutcome, 1)
+	q.mu.Lock()
+	q.waiters[batch.ID] = done
+	q.mu.Unlock()
+	q.notify()
+	q.finish(ctx, batch.ID)
+	ticker := time.NewTicker(batchCheckInterval)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case outcome := <-done:
+			return outcome.result, outcome.err
+		case <-ticker.C:
+			// The batch's last op may have been made by another instance
+			q.finish(ctx, batch.ID)
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	q.mu.Lock()
+	delete(q.waiters, batch.ID)
+	q.mu.Unlock()
+	select {
+	case outcome := <-done:
+		return outcome.result, outcome.err
+	default:
+		return SyncResult{}, ErrStillQueued
+	}
+}
+
+// notify wakes the queue up to run newly queued ops
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run finishes batches left over from before a restart and then runs ops as
+// they come due until ctx is done.
+func (q *Queue) Run(ctx context.Context) {
+	batches, err := q.c.s.GetOpBatches(ctx)
+	if err != nil {
+		q.c.logger.Error("unable to get queued op batches", slog.Any("error", err))
+	}
+	for _, batch := range batches {
+		q.finish(ctx, batch.ID)
+	}
+	for {
+		timer := time.NewTimer(q.runDue(ctx))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// runDue finishes the batches handed off by commands that are no longer
+// waiting for them and runs the pending ops that are due and whose guild isn't
+// paused, returning how long to wait before looking again. Ops another
+// instance has claimed are left to it.
+func (q *Queue) runDue(ctx context.Context) time.Duration {
+	wait, ran := idleWait, false
+	q.mu.Lock()
+	handoffs := maps.Clone(q.handoffs)
+	q.mu.Unlock()
+	for batchID, until := range handoffs {
+		if now := time.Now(); until.After(now) {
+			wait = min(wait, until.Sub(now))
+			continue
+		}
+		q.mu.Lock()
+		delete(q.handoffs, batchID)
+		q.mu.Unlock()
+		q.finish(ctx, batchID)
+	}
+	ops, err := q.c.s.GetPendingOps(ctx)
+	if err != nil {
+		q.c.logger.Error("unable to get pending ops", slog.Any("error", err))
+		return opRetryDelay
+	}
+	for _, op := range ops {
+		if ctx.Err() != nil {
+			return 0
+		}
+		due := op.NextAttempt
+		q.mu.Lock()
+		if until := q.paused[op.GuildID]; until.After(due) {
+			due = until
+		}
+		q.mu.Unlock()
+		if now := time.Now(); due.After(now) {
+			wait = min(wait, due.Sub(now))
+			continue
+		}
+		claimed, ok, err := q.c.s.ClaimOp(ctx, op.ID, time.Now().Add(opLease))
+		if err != nil {
+			q.c.logger.Error("unable to claim op", slog.Int64("id", op.ID), slog.Any("error", err))
+		}
+		if !ok {
+			// Another instance is making it, or already has
+			wait = min(wait, opRetryDelay)
+			continue
+		}
+		q.do(ctx, claimed)
+		q.finish(ctx, op.BatchID)
+		ran = true
+	}
+	if ran {
+		// The ops that were run may have been rescheduled
+		return 0
+	}
+	return wait
+}
+
+// changing reports whether an op is being made to the scheduled event
+func (q *Queue) changing(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.busy[id]
+}
+
+// pause holds off making the guild's ops until then
+func (q *Queue) pause(guildID string, until time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused[guildID] = until
+}
+
+// do makes one attempt at the op, which the caller has claimed, and records
+// how it went, giving up the claim
+func (q *Queue) do(ctx context.Context, op s.Op) {
+	q.work.Lock()
+	defer q.work.Unlock()
+	if op.Event.ID != "" {
+		q.mu.Lock()
+		q.busy[op.Event.ID] = true
+		q.mu.Unlock()
+		defer func() {
+			q.mu.Lock()
+			delete(q.busy, op.Event.ID)
+			q.mu.Unlock()
+		}()
+	}
+	opCtx, cancel := context.WithTimeout(ctx, opTimeout)
+	event, err := q.attempt(opCtx, &op)
+	cancel()
+	op.LeasedUntil = time.Time{}
+	recordCtx, cancel := recordContext(ctx)
+	defer cancel()
+	if err == nil {
+		op.Event = event
+		op.Status = s.OpDone
+		op.Error = ""
+		err = q.c.recordOp(recordCtx, op)
+		if err == nil {
+			return
+		}
+		if op.Kind == s.OpCreate {
+			q.c.unpublishEvents(ctx, op.GuildID, []e.Event{event})
+		}
+		op.Status = s.OpFailed
+	} else {
+		op.Attempts++
+		if answered(err) {
+			op.Started = false
+		}
+		var rateLimitErr *discordgo.RateLimitError
+		switch {
+		case errors.As(err, &rateLimitErr):
+			// Waiting out a rate limit isn't the op's fault, so it doesn't
+			// count as an attempt
+			op.Attempts--
+			op.NextAttempt = time.Now().Add(rateLimitErr.RetryAfter)
+			q.pause(op.GuildID, op.NextAttempt)
+		case retryable(err) && op.Attempts < maxOpAttempts:
+			op.NextAttempt = time.Now().Add(min(opRetryDelay<<(op.Attempts-1), maxOpRetryDelay))
+		default:
+			op.Status = s.OpFailed
+		}
+	}
+	op.Error = err.Error()
+	q.c.logger.Warn("discord op failed", slog.Int64("id", op.ID), slog.String("kind", op.Kind), slog.String("event", op.Event.Name),
+		slog.String("status", op.Status), slog.Int("attempts", op.Attempts), slog.Any("error", err))
+	err = q.c.s.UpdateOp(recordCtx, op)
+	if err != nil {
+		q.c.logger.Error("unable to update op", slog.Int64("id", op.ID), slog.Any("error", err))
+		// The op is still due as far as the store knows
+		q.pause(op.GuildID, time.Now().Add(opRetryDelay))
+	}
+}
+
+// attempt makes the op on Discord. Creates are recorded as started before
+// they are sent, and a create that was started before is first looked for on
+// Discord so it isn't made twice.
+func (q *Queue) attempt(ctx context.Context, op *s.Op) (e.Event, error) {
+	if op.Kind != s.OpCreate {
+		return q.c.makeOp(ctx, *op)
+	}
+	if op.Started {
+		q.mu.Lock()
+		userID := q.userID
+		q.mu.Unlock()
+		scheduled, err := q.c.session.GuildScheduledEvents(op.GuildID, false, discordgo.WithContext(ctx))
+		if err != nil {
+			return op.Event, fmt.Errorf("unable to list discord guild scheduled events: %w", err)
+		}
+		event, found, err := q.c.findCreated(ctx, *op, userID, scheduled)
+		if err != nil || found {
+			return event, err
+		}
+	} else {
+		op.Started = true
+		err := q.c.s.UpdateOp(ctx, *op)
+		if err != nil {
+			op.Started = false
+			return op.Event, fmt.Errorf("unable to record op as started: %w", err)
+		}
+	}
+	return q.c.makeOp(ctx, *op)
+}
+
+// Recover matches creates that were sent to Discord but never recorded, e.g.
+// because the bot stopped in between, back to the scheduled events they made
+// and records them. The ones with no scheduled event are left to be made as
+// normal. It is run once the gateway is ready, before the queue is started.
+func (q *Queue) Recover(ctx context.Context, userID string) error {
+	q.work.Lock()
+	defer q.work.Unlock()
+	q.mu.Lock()
+	q.userID = userID
+	q.mu.Unlock()
+	ops, err := q.c.s.GetPendingOps(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	guildEvents := make(map[string][]*discordgo.GuildScheduledEvent)
+	for _, op := range ops {
+		if op.Kind != s.OpCreate || !op.Started {
+			continue
+		}
+		// Ops another instance is making, or that aren't due yet, are
+		// looked for on Discord when they are next attempted instead
+		claimed, ok, err := q.c.s.ClaimOp(ctx, op.ID, time.Now().Add(opLease))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		op = claimed
+		op.LeasedUntil = time.Time{}
+		scheduled, ok := guildEvents[op.GuildID]
+		if !ok {
+			scheduled, err = q.c.session.GuildScheduledEvents(op.GuildID, false, discordgo.WithContext(ctx))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to list discord guild scheduled events: %w", err))
+				continue
+			}
+			guildEvents[op.GuildID] = scheduled
+		}
+		event, found, err := q.c.findCreated(ctx, op, userID, scheduled)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !found {
+			op.Started = false
+			err = q.c.s.UpdateOp(ctx, op)
+		} else {
+			op.Event = event
+			op.Status = s.OpDone
+			op.Error = ""
+			err = q.c.recordOp(ctx, op)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if found {
+			q.c.logger.Info("recovered unrecorded discord guild scheduled event", slog.String("url", op.URL), slog.String("id", event.ID), slog.String("name", event.Name))
+			q.finish(ctx, op.BatchID)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// finish wraps up the batch once none of its ops are pending: marking the
+// calendar synced or deleting it when unsubscribing if they all succeeded,
+// announcing new events and reporting the outcome to whoever is waiting for
+// it or else the interaction that queued it. A batch whose command is waiting
+// for it on another instance is handed off to that instance until the command
+// stops waiting, and only the instance that deletes the batch announces and
+// reports it.
+func (q *Queue) finish(ctx context.Context, batchID int64) {
+	q.finishing.Lock()
+	defer q.finishing.Unlock()
+	ctx, cancel := recordContext(ctx)
+	defer cancel()
+	ops, err := q.c.s.GetOps(ctx, batchID)
+	if err != nil {
+		q.c.logger.Error("unable to get ops of batch", slog.Int64("batch", batchID), slog.Any("error", err))
+		return
+	}
+	for _, op := range ops {
+		if op.Status == s.OpPending {
+			return
+		}
+	}
+	batch, err := q.c.s.GetOpBatch(ctx, batchID)
+	if errors.Is(err, s.ErrOpBatchNotFound) {
+		// Another instance finished it, and reported it to the interaction
+		q.deliver(batchID, batchOutcome{err: ErrFinishedElsewhere})
+		return
+	}
+	if err != nil {
+		q.c.logger.Error("unable to get op batch", slog.Int64("batch", batchID), slog.Any("error", err))
+		return
+	}
+	q.mu.Lock()
+	_, waiting := q.waiters[batch.ID]
+	if !waiting && time.Now().Before(batch.AwaitedUntil) {
+		q.handoffs[batch.ID] = batch.AwaitedUntil
+		q.mu.Unlock()
+		return
+	}
+	q.mu.Unlock()
+	result, opErr := outcome(ops)
+	err = q.c.s.WithTx(ctx, func(tx s.Store) error {
+		if opErr == nil {
+			var err error
+			switch batch.Action {
+			case s.BatchUnsubscribe:
+				err = tx.DeleteCalendar(ctx, batch.URL)
+			default:
+				err = tx.UpdateLastSynced(ctx, batch.URL)
+			}
+			if err != nil {
+				return fmt.Errorf("unable to update calendar: %w", err)
+			}
+		}
+		return tx.DeleteOpBatch(ctx, batch.ID)
+	})
+	if errors.Is(err, s.ErrOpBatchNotFound) {
+		// Another instance finished it at the same time
+		return
+	}
+	if err != nil {
+		q.c.logger.Error("unable to finish op batch", slog.Int64("batch", batchID), slog.Any("error", err))
+		opErr = errors.Join(opErr, err)
+	}
+	if batch.Action == s.BatchSync {
+		q.c.announce(ctx, batch.GuildID, batch.URL, result.Added)
+	}
+	if !q.deliver(batch.ID, batchOutcome{result: result, err: opErr}) {
+		q.report(ctx, batch, result, opErr)
+	}
+}
+
+// deliver hands the outcome to the command waiting for the batch, reporting
+// whether there was one
+func (q *Queue) deliver(batchID int64, outcome batchOutcome) bool {
+	q.mu.Lock()
+	done, ok := q.waiters[batchID]
+	delete(q.waiters, batchID)
+	q.mu.Unlock()
+	if ok {
+		done <- outcome
+	}
+	return ok
+}
+
+// report edits the response to the interaction that queued the batch to say
+// how it went, as long as Discord still accepts edits to it
+func (q *Queue) report(ctx context.Context, batch s.OpBatch, result SyncResult, err error) {
+	if batch.InteractionToken == "" {
+		return
+	}
+	created, snowflakeErr := discordgo.SnowflakeTimestamp(batch.InteractionID)
+	if snowflakeErr != nil || time.Since(created) > interactionTokenLifetime {
+		q.c.logger.Info("not reporting op batch, its interaction has expired", slog.Int64("batch", batch.ID), slog.String("url", batch.URL))
+		return
+	}
+	content := batchSummary(batch, result, err)
+	_, err = q.c.session.InteractionResponseEdit(&discordgo.Interaction{
+		ID:    batch.InteractionID,
+		AppID: batch.ApplicationID,
+		Token: batch.InteractionToken,
+	}, &discordgo.WebhookEdit{
+		Content:    &content,
+		Components: &[]discordgo.MessageComponent{},
+		Embeds:     &[]*discordgo.MessageEmbed{},
+	}, discordgo.WithContext(ctx))
+	if err != nil {
+		q.c.logger.Error("unable to report op batch outcome", slog.Int64("batch", batch.ID), slog.Any("error", err))
+	}
+}
+
+// batchSummary describes the outcome of a batch whose command stopped waiting
+// for it
+func batchSummary(batch s.OpBatch, result SyncResult, err error) string {
+	var b strings.Builder
+	if batch.Action == s.BatchUnsubscribe && err == nil {
+		fmt.Fprintf(&b, "Unsubscribed from calendar at %s and removed its %d events.", batch.URL, len(result.Removed))
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Finished updating the events of %s: added %d, updated %d and removed %d events.",
+		batch.URL, len(result.Added), len(result.Updated), len(result.Removed))
+	if err != nil {
+		fmt.Fprintf(&b, "\n%s", err)
+	}
+	return b.String()
+}
+
+// outcome summarizes the batch's finished ops, with an error describing the
+// ones that failed
+func outcome(ops []s.Op) (SyncResult, error) {
+	var result SyncResult
+	var errs []error
+	for _, op := range ops {
+		if op.Status == s.OpFailed {
+			result.Failed = append(result.Failed, op.Event)
+			errs = append(errs, fmt.Errorf("unable to %s event %s: %s", op.Kind, op.Event.Name, op.Error))
+			continue
+		}
+		switch op.Kind {
+		case s.OpCreate:
+			result.Added = append(result.Added, op.Event)
+		case s.OpEdit:
+			result.Updated = append(result.Updated, op.Event)
+		case s.OpDelete:
+			result.Removed = append(result.Removed, op.Event)
+		}
+	}
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%d of %d discord changes failed: %w", len(errs), len(ops), errors.Join(errs...))
+	}
+	return result, nil
+}
+
+// answered reports whether Discord responded to the request that failed with
+// err, so it wasn't made
+func answered(err error) bool {
+	var restErr *discordgo.RESTError
+	var rateLimitErr *discordgo.RateLimitError
+	return errors.As(err, &restErr) || errors.As(err, &rateLimitErr)
+}
+
+// permanentError is an error that trying again won't fix
+type permanentError struct {
+	error
+}
+
+func (err permanentError) Unwrap() error {
+	return err.error
+}
+
+// retryable reports whether an op that failed with err is worth trying again,
+// which it is unless Discord rejected the request or it can never succeed.
+func retryable(err error) bool {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) {
+		return restErr.Response != nil && restErr.Response.StatusCode >= http.StatusInternalServerError
+	}
+	var permanent permanentError
+	return !errors.As(err, &permanent)
+}
+
+// opOptions are the request options for making ops. Rate limits are handed
+// back to the queue rather than slept through so other guilds' ops can go
+// ahead in the meantime.
+func opOptions(ctx context.Context) []discordgo.RequestOption {
+	return []discordgo.RequestOption{discordgo.WithContext(ctx), discordgo.WithRetryOnRatelimit(false)}
+}
+
+// makeOp makes the op's change on Discord, returning its event with the
+// scheduled event's ID set
+func (c Cal) makeOp(ctx context.Context, op s.Op) (e.Event, error) {
+	if op.Kind == s.OpCreate {
+		_, err := c.s.GetCalendar(ctx, op.URL)
+		if errors.Is(err, s.ErrCalendarNotFound) {
+			return op.Event, permanentError{fmt.Errorf("calendar at %s is no longer subscribed to", op.URL)}
+		}
+		if err != nil {
+			return op.Event, err
+		}
+		return c.publishEvent(ctx, op.GuildID, op.URL, op.Event)
+	}
+	// The event may have been changed by hand since the op was queued
+	_, stored, err := c.s.GetEvent(ctx, op.Event.ID)
+	if err != nil && !errors.Is(err, s.ErrEventNotFound) {
+		return op.Event, err
+	}
+	if stored.ManuallyRemoved {
+		return op.Event, nil
+	}
+	op.Event.EditedFields = stored.EditedFields
+	switch op.Kind {
+	case s.OpEdit:
+		return op.Event, c.editEvent(ctx, op.GuildID, op.URL, op.Event, stored)
+	case s.OpDelete:
+		err := c.session.GuildScheduledEventDelete(op.GuildID, op.Event.ID, opOptions(ctx)...)
+		if err != nil && !isUnknownScheduledEvent(err) {
+			return op.Event, fmt.Errorf("error deleting discord guild scheduled event: %w", err)
+		}
+		return op.Event, nil
+	}
+	return op.Event, permanentError{fmt.Errorf("unknown op kind %q", op.Kind)}
+}
+
+// findCreated looks through the guild's scheduled events for the one an
+// earlier attempt at the create op made: created by the bot with the op's
+// name and start time, and not recorded as any imported event.
+func (c Cal) findCreated(ctx context.Context, op s.Op, userID string, scheduled []*discordgo.GuildScheduledEvent) (e.Event, bool, error) {
+	if userID == "" {
+		return op.Event, false, errors.New("the bot's user isn't known until the gateway is ready")
+	}
+	for _, candidate := range scheduled {
+		if candidate.CreatorID != userID || candidate.Name != op.Event.Name || !candidate.ScheduledStartTime.Equal(op.Event.StartTime) {
+			continue
+		}
+		_, _, err := c.s.GetEvent(ctx, candidate.ID)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, s.ErrEventNotFound) {
+			return op.Event, false, err
+		}
+		event := op.Event
+		event.ID = candidate.ID
+		return event, true, nil
+	}
+	return op.Event, false, nil
+}
+
+// recordOp records the change the op made on Discord in the events table,
+// in the same transaction as marking the op done
+func (c Cal) recordOp(ctx context.Context, op s.Op) error {
+	return c.s.WithTx(ctx, func(tx s.Store) error {
+		var err error
+		switch op.Kind {
+		case s.OpCreate:
+			_, err = tx.InsertEvent(ctx, op.URL, op.Event)
+		case s.OpEdit:
+			err = tx.UpdateEvent(ctx, op.URL, op.Event)
+		case s.OpDelete:
+			err = tx.DeleteEventsByIDs(ctx, []string{op.Event.ID})
+		}
+		if err != nil {
+			return fmt.Errorf("error recording %s of event %s in database: %w", op.Kind, op.Event.Name, err)
+		}
+		return tx.UpdateOp(ctx, op)
+	})
+}
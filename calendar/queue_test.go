@@ -0,0 +1,79 @@
+package calendar
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+)
+
+func TestQueueInstancesClaimOps(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.store.InsertCalendar(h.ctx, h.url, testGuildID, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	var ops []s.Op
+	for _, event := range upcoming()[:3] {
+		ops = append(ops, s.Op{Kind: s.OpCreate, Event: e.Event{UID: event.uid, Name: event.name, StartTime: event.start, EndTime: event.start.Add(time.Hour)}})
+	}
+	if _, err := h.store.QueueOps(h.ctx, s.OpBatch{Action: s.BatchSync, GuildID: testGuildID, URL: h.url}, ops); err != nil {
+		t.Fatal(err)
+	}
+
+	h.discord.Delay = 10 * time.Millisecond
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 3 {
+		q := h.newQueue(t)
+		wg.Go(func() {
+			<-start
+			q.runDue(h.ctx)
+		})
+	}
+	close(start)
+	wg.Wait()
+	// The harness's queue is an instance as well, which may still be making
+	// an op it claimed
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if batches, _ := h.store.GetOpBatches(h.ctx); len(batches) == 0 {
+			break
+		}
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	if n := h.discord.CallCount("GuildScheduledEventCreate"); n != 3 {
+		t.Errorf("instances made %d creates between them, want 3", n)
+	}
+}
+
+func TestQueueHandsOffAwaitedBatches(t *testing.T) {
+	h := newHarness(t)
+	// The command runs on an instance whose queue is idle while another
+	// instance makes its ops
+	h.cal.q = h.newQueue(t)
+	worker := h.newQueue(t)
+	ctx, cancel := context.WithTimeout(h.ctx, time.Minute)
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			worker.runDue(ctx)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	if err := h.cal.Subscribe(ctx, h.url, h.interaction(), nil); err != nil {
+		t.Fatal(err)
+	}
+	h.assertSynced(t, "Meetup", "Workshop", "Social")
+	// The outcome reached the command rather than being reported separately
+	if n := h.discord.CallCount("InteractionResponseEdit"); n != 3 {
+		t.Errorf("edited the interaction response %d times, want just the command's 3", n)
+	}
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if len(worker.handoffs) != 1 {
+		t.Errorf("worker has handoffs %v, want the subscribe's batch", worker.handoffs)
+	}
+}
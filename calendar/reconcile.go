@@ -0,0 +1,87 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// ScheduledEventDeleted records that an imported event's scheduled event was
+// deleted by hand, so syncs don't recreate it and unsubscribing doesn't try to
+// delete it again. Deletions made by the queue are ignored.
+func (c Cal) ScheduledEventDeleted(ctx context.Context, deleted *discordgo.GuildScheduledEvent) error {
+	if c.q.changing(deleted.ID) {
+		return nil
+	}
+	url, event, err := c.s.GetEvent(ctx, deleted.ID)
+	if errors.Is(err, s.ErrEventNotFound) || err == nil && event.ManuallyRemoved {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Info("imported event deleted by hand", slog.String("url", url), slog.String("id", event.ID), slog.String("name", event.Name))
+	return c.s.MarkEventRemoved(ctx, deleted.ID)
+}
+
+// ScheduledEventUpdated records which fields of an imported event's scheduled
+// event were edited by hand, so syncs leave them alone. Edits made by the
+// queue are ignored.
+func (c Cal) ScheduledEventUpdated(ctx context.Context, updated *discordgo.GuildScheduledEvent) error {
+	if c.q.changing(updated.ID) {
+		return nil
+	}
+	url, event, err := c.s.GetEvent(ctx, updated.ID)
+	if errors.Is(err, s.ErrEventNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := slices.Clone(event.EditedFields)
+	for _, field := range editedFields(event, updated) {
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == len(event.EditedFields) {
+		return nil
+	}
+	c.logger.Info("imported event edited by hand", slog.String("url", url), slog.String("id", event.ID), slog.Any("fields", fields))
+	return c.s.SetEditedFields(ctx, updated.ID, fields)
+}
+
+// editedFields returns the fields of the scheduled event that differ from the
+// imported event it was made from, as Discord stores it
+func editedFields(event e.Event, scheduled *discordgo.GuildScheduledEvent) []string {
+	event = event.ForDiscord()
+	var fields []string
+	if discordText(scheduled.Name) != discordText(event.Name) {
+		fields = append(fields, e.FieldName)
+	}
+	if discordText(scheduled.Description) != discordText(event.Description) {
+		fields = append(fields, e.FieldDescription)
+	}
+	if !scheduled.ScheduledStartTime.Equal(event.StartTime) {
+		fields = append(fields, e.FieldStartTime)
+	}
+	if scheduled.ScheduledEndTime == nil || !scheduled.ScheduledEndTime.Equal(event.EndTime) {
+		fields = append(fields, e.FieldEndTime)
+	}
+	if scheduled.ChannelID != event.ChannelID || event.ChannelID == "" && discordText(scheduled.EntityMetadata.Location) != discordText(event.Location) {
+		fields = append(fields, e.FieldLocation)
+	}
+	return fields
+}
+
+// discordText normalizes text the way Discord does when it stores a scheduled
+// event's fields, trimming surrounding whitespace and using \n line endings
+func discordText(s string) string {
+	return strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+}
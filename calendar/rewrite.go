@@ -0,0 +1,68 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// RewriteRules implements Commands.
+func (c Cal) RewriteRules(ctx context.Context, guildID, url string) (s.RewriteRules, error) {
+	_, err := c.Calendar(ctx, guildID, url)
+	if err != nil {
+		return nil, err
+	}
+	return c.s.GetRewriteRules(ctx, url)
+}
+
+// AddRewriteRule stores a new rewrite rule for the calendar and resyncs it so
+// the already imported events are edited to match. The rule is stored in the
+// same transaction that queues the resync.
+func (c Cal) AddRewriteRule(ctx context.Context, url, field, action, pattern, text string, i *discordgo.InteractionCreate) (s.RewriteRule, SyncResult, error) {
+	_, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return s.RewriteRule{}, SyncResult{}, err
+	}
+	rule, err := s.NewRewriteRule(url, field, action, pattern, text)
+	if err != nil {
+		return s.RewriteRule{}, SyncResult{}, err
+	}
+	var stored s.RewriteRule
+	result, err := c.resync(ctx, i.GuildID, url, i, func(ctx context.Context, tx s.Store) error {
+		created, err := tx.CreateRewriteRule(ctx, *rule)
+		if err != nil {
+			return fmt.Errorf("unable to store rewrite rule: %w", err)
+		}
+		stored = created
+		return nil
+	})
+	if err != nil {
+		return stored, result, err
+	}
+	c.logger.Info("added rewrite rule", slog.String("url", url), slog.Int64("id", stored.ID), slog.Int("updated", len(result.Updated)))
+	return stored, result, nil
+}
+
+// RemoveRewriteRule deletes the rewrite rule and resyncs the calendar so the
+// imported events no longer have it applied. The rule is deleted in the same
+// transaction that queues the resync.
+func (c Cal) RemoveRewriteRule(ctx context.Context, url string, id int64, i *discordgo.InteractionCreate) (s.RewriteRule, SyncResult, error) {
+	_, err := c.Calendar(ctx, i.GuildID, url)
+	if err != nil {
+		return s.RewriteRule{}, SyncResult{}, err
+	}
+	var rule s.RewriteRule
+	result, err := c.resync(ctx, i.GuildID, url, i, func(ctx context.Context, tx s.Store) error {
+		deleted, err := tx.DeleteRewriteRule(ctx, url, id)
+		rule = deleted
+		return err
+	})
+	if err != nil {
+		return rule, result, err
+	}
+	c.logger.Info("removed rewrite rule", slog.String("url", url), slog.Int64("id", id), slog.Int("updated", len(result.Updated)))
+	return rule, result, nil
+}
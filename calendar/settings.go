@@ -0,0 +1,96 @@
+package calendar
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+	"github.com/bwmarrin/discordgo"
+)
+
+// maxAnnouncedEvents is how many new events an announcement lists by name
+const maxAnnouncedEvents = 10
+
+// privacyLevel maps the setting to Discord's privacy level
+func privacyLevel(level s.PrivacyLevel) (discordgo.GuildScheduledEventPrivacyLevel, error) {
+	switch level {
+	case s.PrivacyGuildOnly:
+		return discordgo.GuildScheduledEventPrivacyLevelGuildOnly, nil
+	}
+	return 0, fmt.Errorf("unknown privacy level %q", level)
+}
+
+// Settings implements Commands.
+func (c Cal) Settings(ctx context.Context, guildID, url string) (s.CalendarSettings, error) {
+	cal, err := c.Calendar(ctx, guildID, url)
+	if err != nil {
+		return s.CalendarSettings{}, err
+	}
+	return cal.Settings, nil
+}
+
+// SetSettings validates and stores the calendar's settings, then resyncs it so
+// the imported events pick up the new defaults and emoji. The settings are
+// stored in the same transaction that queues the resync.
+func (c Cal) SetSettings(ctx context.Context, settings s.CalendarSettings, i *discordgo.InteractionCreate) (SyncResult, error) {
+	guildID := i.GuildID
+	_, err := c.Calendar(ctx, guildID, settings.URL)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	err = settings.Validate()
+	if err != nil {
+		return SyncResult{}, err
+	}
+	if settings.AnnouncementChannelID != "" {
+		channel, err := c.session.Channel(settings.AnnouncementChannelID, discordgo.WithContext(ctx))
+		if err != nil {
+			return SyncResult{}, fmt.Errorf("unable to find announcement channel: %w", err)
+		}
+		if channel.GuildID != guildID || !channel.IsThread() && channel.Type != discordgo.ChannelTypeGuildText && channel.Type != discordgo.ChannelTypeGuildNews {
+			return SyncResult{}, fmt.Errorf("announcement channel must be a text channel in this server")
+		}
+	}
+	return c.resync(ctx, guildID, settings.URL, i, func(ctx context.Context, tx s.Store) error {
+		err := tx.SetCalendarSettings(ctx, settings)
+		if err != nil {
+			return fmt.Errorf("unable to store calendar settings: %w", err)
+		}
+		return nil
+	})
+}
+
+// announce posts the newly imported events to the calendar's announcement
+// channel, if it has one. Failing to announce is logged rather than failing
+// the sync that imported them.
+func (c Cal) announce(ctx context.Context, guildID, url string, added []e.Event) {
+	if len(added) == 0 {
+		return
+	}
+	cal, err := c.s.GetCalendar(ctx, url)
+	if err != nil {
+		c.logger.Error("unable to get calendar to announce events", slog.String("url", url), slog.Any("error", err))
+		return
+	}
+	if cal.Settings.AnnouncementChannelID == "" {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "New events from **%s**:", cal.DisplayName())
+	for _, event := range added[:min(len(added), maxAnnouncedEvents)] {
+		fmt.Fprintf(&b, "\n- <t:%d:f> [%s](https://discord.com/events/%s/%s)", event.StartTime.Unix(), event.Name, guildID, event.ID)
+	}
+	if len(added) > maxAnnouncedEvents {
+		fmt.Fprintf(&b, "\nand %d more", len(added)-maxAnnouncedEvents)
+	}
+	_, err = c.session.ChannelMessageSendComplex(cal.Settings.AnnouncementChannelID, &discordgo.MessageSend{
+		Content:         b.String(),
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}, discordgo.WithContext(ctx))
+	if err != nil {
+		c.logger.Error("unable to announce new events", slog.String("url", url), slog.String("channel", cal.Settings.AnnouncementChannelID), slog.Any("error", err))
+	}
+}
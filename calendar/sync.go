@@ -0,0 +1,436 @@
+package calendar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	e "git.phlcode.club/discord-bot/events"
+	s "git.phlcode.club/discord-bot/store"
+	ics "github.com/arran4/golang-ical"
+	"github.com/bwmarrin/discordgo"
+)
+
+// recordTimeout bounds recording changes that have already been made on
+// Discord
+const recordTimeout = 10 * time.Second
+
+// recordContext returns the context for recording changes already made on
+// Discord, which goes ahead even if ctx is done so the store doesn't lose
+// track of them.
+func recordContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), recordTimeout)
+}
+
+// fetchCalendar downloads the remote calendar and parses its events, skipping
+// ones that can't be parsed.
+func (c Cal) fetchCalendar(ctx context.Context, url string) (*ics.Calendar, []e.Event, error) {
+	cal, err := fetchFeed(ctx, url)
+	if err != nil {
+		return nil, nil, errors.Join(errors.New("unable to fetch and parse remote ics"), err)
+	}
+	events := make([]e.Event, 0, len(cal.Events()))
+	for _, event := range cal.Events() {
+		var currEvent e.Event
+		err := currEvent.ParseFromiCal(event)
+		if err != nil {
+			c.logger.Error("error parsing ical event", slog.Any("event", event), slog.Any("error", err))
+			continue
+		}
+		events = append(events, currEvent)
+	}
+	return cal, events, nil
+}
+
+// prepareEvents applies the calendar's rewrite rules and settings, as st has
+// them, to the fetched events before fitting them within Discord's limits and
+// picking their channel. Events that start beyond the calendar's horizon are
+// dropped.
+func prepareEvents(ctx context.Context, st s.Store, url string, fetched []e.Event) ([]e.Event, error) {
+	rules, err := st.GetRewriteRules(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := st.GetChannelRules(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := st.GetCalendarSettings(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	var horizon time.Time
+	if settings.HorizonDays > 0 {
+		horizon = time.Now().AddDate(0, 0, settings.HorizonDays)
+	}
+	events := make([]e.Event, 0, len(fetched))
+	for _, event := range fetched {
+		if !horizon.IsZero() && event.StartTime.After(horizon) {
+			continue
+		}
+		event = settings.Apply(rules.Apply(event)).ForDiscord()
+		event.ChannelID = channels.Channel(event)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// fetchFeed downloads and parses the remote calendar
+func fetchFeed(ctx context.Context, url string) (*ics.Calendar, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return e.ParseCalendar(resp.Body)
+}
+
+// SyncResult describes how a resync changed the calendar's Discord events
+type SyncResult struct {
+	Added   []e.Event
+	Removed []e.Event
+	Updated []e.Event
+	// Failed are the events Discord wouldn't change, even after retrying
+	Failed []e.Event
+}
+
+// shouldImport reports whether the event is kept by the filters and has not
+// already started.
+func (c Cal) shouldImport(event e.Event, filters s.Filters, loc *time.Location) bool {
+	if !filters.Keep(event, loc) {
+		c.logger.Debug("filtered event", slog.String("name", event.Name))
+		return false
+	}
+	if event.StartTime.Before(time.Now()) {
+		c.logger.Debug("past event", slog.String("name", event.Name), slog.String("startTime", event.StartTime.Format("2006-1-2 3:04PM")))
+		return false
+	}
+	return true
+}
+
+// scheduledEventParams describes event as a guild scheduled event, hosted in
+// its channel if it has one and at its location otherwise. The cover image is
+// left for the caller to add, see eventImage.
+func (c Cal) scheduledEventParams(ctx context.Context, guildID, url string, event e.Event) (*discordgo.GuildScheduledEventParams, error) {
+	settings, err := c.s.GetCalendarSettings(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	privacy, err := privacyLevel(settings.PrivacyLevel)
+	if err != nil {
+		return nil, err
+	}
+	params := &discordgo.GuildScheduledEventParams{
+		Name:               event.Name,
+		Description:        event.Description,
+		ScheduledStartTime: &event.StartTime,
+		ScheduledEndTime:   &event.EndTime,
+		Status:             discordgo.GuildScheduledEventStatusScheduled,
+		EntityType:         discordgo.GuildScheduledEventEntityTypeExternal,
+		EntityMetadata: &discordgo.GuildScheduledEventEntityMetadata{
+			Location: event.Location,
+		},
+		PrivacyLevel: privacy,
+	}
+	if event.ChannelID == "" {
+		return params, nil
+	}
+	entityType, err := c.channelEntityType(ctx, guildID, event.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	params.EntityType = entityType
+	params.ChannelID = event.ChannelID
+	params.EntityMetadata = nil
+	return params, nil
+}
+
+// publishEvent creates the guild scheduled event for event with its cover
+// image, returning the event with its Discord ID set. Recording it in the store is left to the
+// queue so it can be done in the same transaction as marking the op done.
+func (c Cal) publishEvent(ctx context.Context, guildID, url string, event e.Event) (e.Event, error) {
+	params, err := c.scheduledEventParams(ctx, guildID, url, event)
+	if err != nil {
+		return event, err
+	}
+	params.Image = c.eventImage(ctx, url, event)
+	created, err := c.session.GuildScheduledEventCreate(guildID, params, opOptions(ctx)...)
+	if err != nil {
+		return event, fmt.Errorf("error creating discord guild scheduled event: %w", err)
+	}
+	event.ID = created.ID
+	return event, nil
+}
+
+// unpublishEvents deletes scheduled events that were created on Discord but
+// could not be recorded in the store, so they aren't left behind untracked.
+// This runs even when ctx has been cancelled.
+func (c Cal) unpublishEvents(ctx context.Context, guildID string, events []e.Event) {
+	ctx = context.WithoutCancel(ctx)
+	for _, event := range events {
+		err := c.session.GuildScheduledEventDelete(guildID, event.ID, discordgo.WithContext(ctx))
+		if err != nil && !isUnknownScheduledEvent(err) {
+			c.logger.Error("error deleting unrecorded discord guild scheduled event", slog.String("id", event.ID), slog.Any("error", err))
+		}
+	}
+}
+
+// editEvent edits the imported event's guild scheduled event to match event,
+// apart from the fields that have been edited by hand. The cover image is only
+// downloaded and sent again when the event's image changed since it was
+// stored as previous.
+func (c Cal) editEvent(ctx context.Context, guildID, url string, event, previous e.Event) error {
+	params, err := c.scheduledEventParams(ctx, guildID, url, event)
+	if err != nil {
+		return err
+	}
+	if event.ImageURL != previous.ImageURL {
+		params.Image = c.eventImage(ctx, url, event)
+	}
+	// Fields left empty are left as they are by Discord
+	if event.Edited(e.FieldName) {
+		params.Name = ""
+	}
+	if event.Edited(e.FieldDescription) {
+		params.Description = ""
+	}
+	if event.Edited(e.FieldStartTime) {
+		params.ScheduledStartTime = nil
+	}
+	if event.Edited(e.FieldEndTime) {
+		params.ScheduledEndTime = nil
+	}
+	if event.Edited(e.FieldLocation) {
+		params.ChannelID = ""
+		params.EntityType = 0
+		params.EntityMetadata = nil
+	}
+	_, err = c.session.GuildScheduledEventEdit(guildID, event.ID, params, opOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("error editing discord guild scheduled event: %w", err)
+	}
+	return nil
+}
+
+// changed reports whether the remote calendar's version of an imported event
+// differs from what is on Discord, either because the event was edited at the
+// source or because the rewrite rules now produce different text.
+func changed(imported, current e.Event) bool {
+	return imported.SourceHash != current.SourceHash ||
+		!imported.StartTime.Equal(current.StartTime) ||
+		!imported.EndTime.Equal(current.EndTime) ||
+		imported.Name != current.Name ||
+		imported.Description != current.Description ||
+		imported.Location != current.Location ||
+		imported.ChannelID != current.ChannelID ||
+		imported.ImageURL != current.ImageURL
+}
+
+// eventUID identifies an event in the remote calendar by its iCal UID,
+// falling back to its name for events without one. Recurring instances share
+// a UID.
+func eventUID(event e.Event) string {
+	if event.UID == "" {
+		return event.Name
+	}
+	return event.UID
+}
+
+// eventKey identifies an event across fetches of the remote calendar, with the
+// start time telling recurring instances apart.
+func eventKey(event e.Event) string {
+	return eventUID(event) + "@" + event.StartTime.UTC().Format(time.RFC3339)
+}
+
+// matchEvents pairs the imported events with their current version in the
+// remote calendar, keyed by Discord ID, returning the remote events left over.
+// Events are matched by eventKey, then the ones whose start time moved at the
+// source are matched by UID, earliest first.
+func matchEvents(stored, fetched []e.Event) (map[string]e.Event, []e.Event) {
+	current := make(map[string]e.Event, len(fetched))
+	for _, event := range fetched {
+		current[eventKey(event)] = event
+	}
+	matched := make(map[string]e.Event, len(stored))
+	var unmatched []e.Event
+	for _, event := range stored {
+		latest, ok := current[eventKey(event)]
+		if !ok {
+			unmatched = append(unmatched, event)
+			continue
+		}
+		matched[event.ID] = latest
+		delete(current, eventKey(event))
+	}
+	moved := make(map[string][]e.Event)
+	for _, event := range fetched {
+		if _, ok := current[eventKey(event)]; ok {
+			moved[eventUID(event)] = append(moved[eventUID(event)], event)
+		}
+	}
+	byStart := func(a, b e.Event) int { return a.StartTime.Compare(b.StartTime) }
+	for _, candidates := range moved {
+		slices.SortStableFunc(candidates, byStart)
+	}
+	slices.SortStableFunc(unmatched, byStart)
+	for _, event := range unmatched {
+		candidates := moved[eventUID(event)]
+		if len(candidates) == 0 {
+			continue
+		}
+		matched[event.ID] = candidates[0]
+		moved[eventUID(event)] = candidates[1:]
+		delete(current, eventKey(candidates[0]))
+	}
+	var rest []e.Event
+	for _, event := range fetched {
+		if _, ok := current[eventKey(event)]; ok {
+			rest = append(rest, event)
+			delete(current, eventKey(event))
+		}
+	}
+	return matched, rest
+}
+
+// SyncPlan is the set of changes a resync would make to a calendar's Discord
+// events
+type SyncPlan struct {
+	GuildID string
+	URL     string
+	// Keep are imported events the filters still keep that are unchanged
+	Keep []e.Event
+	// Update are imported events the filters still keep that have changed,
+	// including ones that moved to another time, with their Discord IDs set
+	Update []e.Event
+	// Remove are imported events the filters no longer keep and upcoming
+	// ones that were deleted from the remote calendar
+	Remove []e.Event
+	// Add are upcoming events from the remote calendar the filters keep that
+	// have not been imported yet
+	Add []e.Event
+}
+
+// plan works out how the calendar's imported events would change if it were
+// resynced with the fetched events and the given filters, going by what st
+// has stored. Events already queued to be created aren't added again.
+func (c Cal) plan(ctx context.Context, st s.Store, guildID, url string, fetched []e.Event, filters s.Filters) (SyncPlan, error) {
+	plan := SyncPlan{GuildID: guildID, URL: url}
+	loc, err := st.GetGuildTimezone(ctx, guildID)
+	if err != nil {
+		return plan, err
+	}
+	fetched, err = prepareEvents(ctx, st, url, fetched)
+	if err != nil {
+		return plan, err
+	}
+	stored, err := st.GetEventsForURL(ctx, url)
+	if err != nil {
+		return plan, fmt.Errorf("unable to fetch events from db: %w", err)
+	}
+	pending, err := st.GetPendingOps(ctx)
+	if err != nil {
+		return plan, fmt.Errorf("unable to fetch queued ops from db: %w", err)
+	}
+	queued := make(map[string]bool)
+	for _, op := range pending {
+		if op.URL == url && op.Kind == s.OpCreate {
+			queued[eventKey(op.Event)] = true
+		}
+	}
+
+	matched, rest := matchEvents(stored, fetched)
+	now := time.Now()
+	for _, event := range stored {
+		latest, ok := matched[event.ID]
+		if !ok {
+			latest = event
+		}
+		latest.ID = event.ID
+		latest.EditedFields = event.EditedFields
+		switch {
+		case event.ManuallyRemoved:
+			// Deleted by hand, so it is left deleted whatever the filters say
+			plan.Keep = append(plan.Keep, event)
+		case !ok && event.StartTime.After(now):
+			// Deleted from the remote calendar before it took place
+			plan.Remove = append(plan.Remove, event)
+		case !filters.Keep(latest, loc):
+			plan.Remove = append(plan.Remove, event)
+		case ok && latest.StartTime.After(now) && changed(event, latest):
+			plan.Update = append(plan.Update, latest)
+		default:
+			plan.Keep = append(plan.Keep, event)
+		}
+	}
+	for _, event := range rest {
+		if !queued[eventKey(event)] && c.shouldImport(event, filters, loc) {
+			plan.Add = append(plan.Add, event)
+		}
+	}
+	return plan, nil
+}
+
+// ops are the changes to queue to carry out the plan, deleting the removed
+// events before editing the updated ones and creating the added ones
+func (p SyncPlan) ops() []s.Op {
+	ops := make([]s.Op, 0, len(p.Remove)+len(p.Update)+len(p.Add))
+	for _, event := range p.Remove {
+		ops = append(ops, s.Op{Kind: s.OpDelete, Event: event})
+	}
+	for _, event := range p.Update {
+		ops = append(ops, s.Op{Kind: s.OpEdit, Event: event})
+	}
+	for _, event := range p.Add {
+		ops = append(ops, s.Op{Kind: s.OpCreate, Event: event})
+	}
+	return ops
+}
+
+// resync brings the calendar's Discord events in line with the remote
+// calendar and its stored filters, rewrite rules and settings, after making
+// any changes change makes to them. Imported events the filters no longer
+// keep or that were deleted at the source are deleted, ones that changed or
+// moved are edited and upcoming events they keep that have not been imported
+// yet are created. The remote calendar is fetched first, then the changes are
+// planned and queued in one transaction with the calendar locked, so
+// concurrent resyncs can't queue the same change twice. Changes Discord
+// refuses are reported in the result's Failed events and the error, the ones
+// it made are recorded regardless.
+func (c Cal) resync(ctx context.Context, guildID, url string, i *discordgo.InteractionCreate, change func(ctx context.Context, tx s.Store) error) (SyncResult, error) {
+	_, fetched, err := c.fetchCalendar(ctx, url)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	return c.q.run(ctx, newBatch(s.BatchSync, guildID, url, i), func(ctx context.Context, tx s.Store) ([]s.Op, error) {
+		err := tx.LockCalendar(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		if change != nil {
+			err = change(ctx, tx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filters, err := tx.GetFiltersForURL(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		plan, err := c.plan(ctx, tx, guildID, url, fetched, filters)
+		if err != nil {
+			return nil, err
+		}
+		return plan.ops(), nil
+	})
+}
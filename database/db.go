@@ -1,47 +1,72 @@
 package database
 
 import (
-	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "modernc.org/sqlite"
 )
 
-func InitDatabase(dbPath string) (*sql.DB, error) {
+// The database drivers DB_DRIVER can select
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// sqliteBusyTimeout is how long, in milliseconds, a SQLite connection waits
+// for another connection's write to finish rather than failing with
+// SQLITE_BUSY
+const sqliteBusyTimeout = 5000
+
+// sqliteDSN adds the connection options the bot relies on to a SQLite DSN,
+// unless it sets them itself. Concurrent writers, such as the op queue and the
+// poller, wait on each other for up to sqliteBusyTimeout, and transactions
+// take the write lock when they begin so that waiting can't deadlock on a
+// read lock being upgraded.
+func sqliteDSN(dsn string) string {
+	var options []string
+	if !strings.Contains(dsn, "busy_timeout") {
+		options = append(options, fmt.Sprintf("_pragma=busy_timeout(%d)", sqliteBusyTimeout))
+	}
+	if !strings.Contains(dsn, "_txlock") {
+		options = append(options, "_txlock=immediate")
+	}
+	if len(options) == 0 {
+		return dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	return dsn + separator + strings.Join(options, "&")
+}
+
+// InitDatabase opens the database, a SQLite file path or a Postgres
+// connection string depending on driver, and migrates it to the current
+// schema.
+func InitDatabase(driver, dsn string) (*sql.DB, error) {
 	var db *sql.DB
-	if dbPath == "" {
-		dbPath = "./database/calendars.db"
+	var err error
+	switch driver {
+	case DriverSQLite, "":
+		driver = DriverSQLite
+		if dsn == "" {
+			dsn = "./database/calendars.db"
+		}
+		db, err = sql.Open("sqlite", sqliteDSN(dsn))
+	case DriverPostgres:
+		db, err = sql.Open("pgx", dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, expected %s or %s", driver, DriverSQLite, DriverPostgres)
 	}
-	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.ExecContext(
-		context.Background(),
-		`
-		CREATE TABLE IF NOT EXISTS calendars (
-			url TEXT PRIMARY KEY,
-			last_synced TIMESTAMP
-		);
-		CREATE TABLE IF NOT EXISTS events (
-			id TEXT PRIMARY KEY,
-			calendar_url TEXT NOT NULL REFERENCES calendars(url),
-			name TEXT NOT NULL,
-			description TEXT NOT NULL,
-			start_time TIMESTAMP NOT NULL,
-			end_time TIMESTAMP NOT NULL,
-			location TEXT
-		);
-		CREATE TABLE IF NOT EXISTS filters (
-			calendar_url TEXT NOT NULL REFERENCES calendars(url),
-			field TEXT NOT NULL,
-			pattern TEXT NOT NULL,
-			CHECK (field IN ('name', 'description', 'location')),
-			PRIMARY KEY (calendar_url, field, pattern)
-		);
-		`,
-	)
+	err = Migrate(db, driver)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 	return db, err
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles holds the schema changes, named NNNN_description.sql and
+// applied in order. A migration must never be edited once released, changes
+// go in a new one. Migrations are shared between the database drivers, when
+// one needs different SQL it goes in NNNN_description.<driver>.sql and is run
+// in place of the shared file.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew means the database has been migrated by a newer version of
+// the bot, which this version can't safely run against.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of the bot")
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations reads the embedded migrations for driver, checking they are
+// numbered from 1 without gaps.
+func migrations(driver string) ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]migration, 0, len(files))
+	overrides := make(map[string]string)
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		name, dialect, ok := strings.Cut(name, ".")
+		if ok {
+			if dialect == driver {
+				overrides[name] = file
+			}
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s is not numbered: %w", file, err)
+		}
+		if version != len(ms)+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", file, len(ms)+1)
+		}
+		ms = append(ms, migration{version: version, name: name, sql: file})
+	}
+	for i, m := range ms {
+		if file, ok := overrides[m.name]; ok {
+			m.sql = file
+		}
+		src, err := migrationFiles.ReadFile(m.sql)
+		if err != nil {
+			return nil, err
+		}
+		m.sql = string(src)
+		ms[i] = m
+	}
+	return ms, nil
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, 0 if it has none.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version;`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("unable to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Migrate brings the database's schema up to date, applying each migration it
+// is missing in its own transaction. It refuses to touch a database migrated
+// past the newest migration this binary knows about.
+func Migrate(db *sql.DB, driver string) error {
+	ms, err := migrations(driver)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create schema_version table: %w", err)
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > len(ms) {
+		return fmt.Errorf("%w: database is at version %d but the newest known is %d", ErrSchemaTooNew, current, len(ms))
+	}
+	for _, m := range ms[current:] {
+		err = apply(db, driver, m)
+		if err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		slog.Info("applied database migration", slog.Int("version", m.version), slog.String("name", m.name))
+	}
+	return nil
+}
+
+func apply(db *sql.DB, driver string, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(m.sql)
+	if err != nil {
+		return err
+	}
+	insert := `INSERT INTO schema_version (version, name) VALUES (?, ?);`
+	if driver == DriverPostgres {
+		insert = `INSERT INTO schema_version (version, name) VALUES ($1, $2);`
+	}
+	_, err = tx.Exec(insert, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,22 @@
+-- The schema as it was before migrations were introduced. Databases created
+-- back then already have these tables.
+CREATE TABLE IF NOT EXISTS calendars (
+	url TEXT PRIMARY KEY,
+	last_synced TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS events (
+	id TEXT PRIMARY KEY,
+	calendar_url TEXT NOT NULL REFERENCES calendars(url),
+	name TEXT NOT NULL,
+	description TEXT NOT NULL,
+	start_time TIMESTAMP NOT NULL,
+	end_time TIMESTAMP NOT NULL,
+	location TEXT
+);
+CREATE TABLE IF NOT EXISTS filters (
+	calendar_url TEXT NOT NULL REFERENCES calendars(url),
+	field TEXT NOT NULL,
+	pattern TEXT NOT NULL,
+	CHECK (field IN ('name', 'description', 'location')),
+	PRIMARY KEY (calendar_url, field, pattern)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE guilds (
+	guild_id TEXT PRIMARY KEY,
+	timezone TEXT NOT NULL DEFAULT 'UTC'
+);
+ALTER TABLE calendars ADD COLUMN guild_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE calendars ADD COLUMN name TEXT NOT NULL DEFAULT '';
+ALTER TABLE calendars ADD COLUMN cover_image TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN uid TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN categories TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN organizer TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN url TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN status TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN source_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN channel_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE events ADD COLUMN image_url TEXT NOT NULL DEFAULT '';
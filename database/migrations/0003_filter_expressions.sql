@@ -0,0 +1,17 @@
+-- Filters went from a regex per field to include/exclude filter expressions.
+-- The old filters kept events whose field matched the regex, which is an
+-- include filter using the ~ operator.
+CREATE TABLE filters_new (
+	id INTEGER PRIMARY KEY,
+	calendar_url TEXT NOT NULL REFERENCES calendars(url),
+	mode TEXT NOT NULL DEFAULT 'include',
+	expression TEXT NOT NULL,
+	ignore_case BOOLEAN NOT NULL DEFAULT TRUE,
+	CHECK (mode IN ('include', 'exclude')),
+	UNIQUE (calendar_url, mode, expression, ignore_case)
+);
+INSERT INTO filters_new (calendar_url, mode, expression, ignore_case)
+SELECT calendar_url, 'include', field || ' ~ "' || replace(replace(pattern, '\', '\\'), '"', '\"') || '"', FALSE
+FROM filters;
+DROP TABLE filters;
+ALTER TABLE filters_new RENAME TO filters;
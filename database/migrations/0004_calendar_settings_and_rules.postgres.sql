@@ -0,0 +1,28 @@
+CREATE TABLE calendar_settings (
+	calendar_url TEXT PRIMARY KEY REFERENCES calendars(url),
+	display_name TEXT NOT NULL DEFAULT '',
+	color INTEGER NOT NULL DEFAULT 0,
+	emoji TEXT NOT NULL DEFAULT '',
+	privacy_level TEXT NOT NULL DEFAULT 'guild_only',
+	default_duration_minutes INTEGER NOT NULL DEFAULT 60,
+	default_location TEXT NOT NULL DEFAULT '',
+	announcement_channel_id TEXT NOT NULL DEFAULT '',
+	horizon_days INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE rewrite_rules (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	calendar_url TEXT NOT NULL REFERENCES calendars(url),
+	field TEXT NOT NULL,
+	action TEXT NOT NULL,
+	pattern TEXT NOT NULL DEFAULT '',
+	text TEXT NOT NULL DEFAULT '',
+	CHECK (field IN ('name', 'description', 'location')),
+	CHECK (action IN ('replace', 'strip', 'prefix', 'suffix'))
+);
+CREATE TABLE channel_rules (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	calendar_url TEXT NOT NULL REFERENCES calendars(url),
+	pattern_type TEXT NOT NULL DEFAULT 'substring',
+	pattern TEXT NOT NULL,
+	channel_id TEXT NOT NULL
+);
@@ -0,0 +1,26 @@
+-- Changes to guild scheduled events waiting to be made on Discord, kept in
+-- the database so they resume after a restart
+CREATE TABLE discord_op_batches (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	action TEXT NOT NULL,
+	guild_id TEXT NOT NULL,
+	calendar_url TEXT NOT NULL,
+	application_id TEXT NOT NULL DEFAULT '',
+	interaction_id TEXT NOT NULL DEFAULT '',
+	interaction_token TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	CHECK (action IN ('sync', 'unsubscribe'))
+);
+CREATE TABLE discord_ops (
+	id INTEGER GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	batch_id INTEGER NOT NULL REFERENCES discord_op_batches(id),
+	kind TEXT NOT NULL,
+	event TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	CHECK (kind IN ('create', 'edit', 'delete')),
+	CHECK (status IN ('pending', 'done', 'failed'))
+);
+CREATE INDEX discord_ops_due ON discord_ops (status, next_attempt_at);
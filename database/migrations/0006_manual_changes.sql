@@ -0,0 +1,3 @@
+-- Changes made by hand on Discord to imported events, which syncs respect
+ALTER TABLE events ADD COLUMN manually_removed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE events ADD COLUMN edited_fields TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- Creates sent to Discord that may have gone through without being recorded,
+-- which are matched back to their scheduled events before being retried
+ALTER TABLE discord_ops ADD COLUMN started BOOLEAN NOT NULL DEFAULT FALSE;
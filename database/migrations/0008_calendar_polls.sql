@@ -0,0 +1,3 @@
+-- When a calendar was last claimed for a periodic resync, so that only one
+-- instance sharing the database polls it
+ALTER TABLE calendars ADD COLUMN polled_at TIMESTAMP;
@@ -0,0 +1,6 @@
+-- Lets instances sharing the database split up the op queue. An op is only
+-- made by the instance holding an unexpired lease on it, and a batch is only
+-- finished by the instance whose command is waiting for it until the command
+-- stops waiting.
+ALTER TABLE discord_ops ADD COLUMN leased_until TIMESTAMP;
+ALTER TABLE discord_op_batches ADD COLUMN awaited_until TIMESTAMP;
@@ -0,0 +1,7 @@
+-- Event categories were stored comma separated, which split categories that
+-- contain a comma, so they are stored as a JSON array instead. Escaping
+-- backslashes and quotes turns each comma separated category into a JSON
+-- string.
+UPDATE events
+SET categories = '["' || REPLACE(REPLACE(REPLACE(categories, '\', '\\'), '"', '\"'), ',', '","') || '"]'
+WHERE categories != '';
@@ -1,9 +1,14 @@
 package events
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
 	u "git.phlcode.club/discord-bot/utils"
@@ -11,17 +16,111 @@ import (
 )
 
 type Event struct {
-	ID          string
+	ID string
+	// UID is the iCal UID of the event in the remote calendar
+	UID         string
 	Name        string
 	Description string
 	StartTime   time.Time
 	EndTime     time.Time
 	Location    string
+	Categories  []string
+	// Organizer is the organizer's common name, or their address if the feed
+	// doesn't provide one
+	Organizer string
+	URL       string
+	// Status is the iCal STATUS, one of TENTATIVE, CONFIRMED or CANCELLED
+	Status string
+	// SourceHash is the Hash of the event as it appears in the remote
+	// calendar, before any rewrite rules were applied
+	SourceHash string
+	// ChannelID is the voice or stage channel the event is hosted in, or ""
+	// for events at an external location
+	ChannelID string
+	// ImageURL is the address of the event's cover image from its IMAGE or
+	// image ATTACH property
+	ImageURL string
+	// ManuallyRemoved is set once the event's scheduled event has been
+	// deleted by hand on Discord, after which it is never recreated
+	ManuallyRemoved bool
+	// EditedFields are the fields of the scheduled event that have been
+	// edited by hand on Discord, which syncs leave alone
+	EditedFields []string
 }
 
+// The fields of a scheduled event that can be edited by hand on Discord
+const (
+	FieldName        = "name"
+	FieldDescription = "description"
+	// FieldLocation is where the event is hosted, its location or channel
+	FieldLocation  = "location"
+	FieldStartTime = "start_time"
+	FieldEndTime   = "end_time"
+)
+
+// Edited reports whether the field has been edited by hand on Discord
+func (e Event) Edited(field string) bool {
+	return slices.Contains(e.EditedFields, field)
+}
+
+// Hash summarizes the parts of the event shown on Discord, so a change in the
+// remote calendar can be detected without keeping the original text around.
+func (e Event) Hash() string {
+	h := sha256.New()
+	for _, s := range []string{e.Name, e.Description, e.Location, e.StartTime.UTC().Format(time.RFC3339), e.EndTime.UTC().Format(time.RFC3339)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ParseCalendar parses an iCal feed. The parser unescapes TEXT values, which
+// loses the difference between the commas separating CATEGORIES and escaped
+// commas within a category, so their backslashes are escaped once more
+// beforehand for ParseFromiCal to split and unescape them itself.
+func ParseCalendar(r io.Reader) (*ics.Calendar, error) {
+	var b strings.Builder
+	stream := ics.NewCalendarStream(r)
+	for {
+		line, err := stream.ReadLine()
+		if line != nil && len(*line) > 0 {
+			b.WriteString(escapeCategories(string(*line)))
+			b.WriteString("\r\n")
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ics.ParseCalendar(strings.NewReader(b.String()))
+}
+
+// escapeCategories escapes the backslashes in the value of an unfolded
+// CATEGORIES content line, leaving any other line as it is
+func escapeCategories(line string) string {
+	end := strings.IndexAny(line, ";:")
+	if end < 0 || !strings.EqualFold(line[:end], string(ics.ComponentPropertyCategories)) {
+		return line
+	}
+	quoted := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ':' && !quoted:
+			return line[:i+1] + strings.ReplaceAll(line[i+1:], `\`, `\\`)
+		}
+	}
+	return line
+}
+
+// ParseFromiCal fills in the event from a VEVENT of a calendar parsed by
+// ParseCalendar
 func (e *Event) ParseFromiCal(event *ics.VEvent) error {
 	err := u.HandleICSProp(event.GetProperty(ics.ComponentPropertySummary), true, func(val string) error {
-		e.Name = val
+		e.Name = strings.TrimSpace(val)
 		return nil
 	})
 	if err != nil {
@@ -52,8 +151,20 @@ func (e *Event) ParseFromiCal(event *ics.VEvent) error {
 	if err != nil {
 		return errors.Join(errors.New("error handling end time: "), err)
 	}
+	err = u.HandleICSProp(event.GetProperty(ics.ComponentPropertyUniqueId), false, func(val string) error {
+		e.UID = val
+		return nil
+	})
+	if err != nil {
+		slog.Default().Warn("Err was not nil when parsing optional event uid", "error", err)
+		// This is purposefull empty because we should never get here since this isn't required
+	}
 	err = u.HandleICSProp(event.GetProperty(ics.ComponentPropertyDescription), false, func(val string) error {
 		e.Description = val
+		if looksLikeHTML(e.Description) {
+			e.Description = HTMLToMarkdown(e.Description)
+		}
+		e.Description = strings.TrimSpace(e.Description)
 		return nil
 	})
 	if err != nil {
@@ -61,12 +172,111 @@ func (e *Event) ParseFromiCal(event *ics.VEvent) error {
 		// This is purposefull empty because we should never get here since this isn't required
 	}
 	err = u.HandleICSProp(event.GetProperty(ics.ComponentPropertyLocation), false, func(val string) error {
-		e.Location = val
+		e.Location = strings.TrimSpace(val)
 		return nil
 	})
 	if err != nil {
 		slog.Default().Warn("Err was not nil when parsing optional event location", "error", err)
 		// This is purposefull empty because we should never get here since this isn't required
 	}
+	// Outlook and friends put the HTML version of the description in
+	// X-ALT-DESC, which keeps the links and formatting the plain text loses
+	for _, prop := range event.GetProperties(ics.ComponentProperty("X-ALT-DESC")) {
+		if fmtType, ok := prop.ICalParameters[string(ics.ParameterFmttype)]; ok && len(fmtType) > 0 && strings.EqualFold(fmtType[0], "text/html") {
+			if desc := HTMLToMarkdown(prop.Value); desc != "" {
+				e.Description = desc
+			}
+			break
+		}
+	}
+	for _, prop := range event.GetProperties(ics.ComponentPropertyCategories) {
+		for _, category := range splitText(prop.Value) {
+			if category = strings.TrimSpace(category); category != "" {
+				e.Categories = append(e.Categories, category)
+			}
+		}
+	}
+	if prop := event.GetProperty(ics.ComponentPropertyOrganizer); prop != nil {
+		// Unlike TEXT values the parser leaves CAL-ADDRESS values escaped,
+		// parameters like CN it does unescape
+		e.Organizer = ics.FromText(prop.Value)
+		if scheme, address, ok := strings.Cut(e.Organizer, ":"); ok && strings.EqualFold(scheme, "mailto") {
+			e.Organizer = address
+		}
+		if cn, ok := prop.ICalParameters[string(ics.ParameterCn)]; ok && len(cn) > 0 && cn[0] != "" {
+			e.Organizer = cn[0]
+		}
+		e.Organizer = strings.TrimSpace(e.Organizer)
+	}
+	err = u.HandleICSProp(event.GetProperty(ics.ComponentPropertyUrl), false, func(val string) error {
+		e.URL = val
+		return nil
+	})
+	if err != nil {
+		slog.Default().Warn("Err was not nil when parsing optional event url", "error", err)
+		// This is purposefull empty because we should never get here since this isn't required
+	}
+	err = u.HandleICSProp(event.GetProperty(ics.ComponentPropertyStatus), false, func(val string) error {
+		e.Status = strings.ToUpper(val)
+		return nil
+	})
+	if err != nil {
+		slog.Default().Warn("Err was not nil when parsing optional event status", "error", err)
+		// This is purposefull empty because we should never get here since this isn't required
+	}
+	e.ImageURL = imageURL(event)
+	e.SourceHash = e.Hash()
 	return nil
 }
+
+// splitText splits a list of iCal TEXT values on the commas that separate
+// them, leaving escaped commas within a value alone, and unescapes each value
+func splitText(list string) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '\\':
+			i++
+		case ',':
+			values = append(values, ics.FromText(list[start:i]))
+			start = i + 1
+		}
+	}
+	return append(values, ics.FromText(list[start:]))
+}
+
+// imageExtensions are the image formats Discord accepts as a cover, used to
+// spot images attached without a FMTTYPE
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
+
+// imageURL returns the first http(s) image referenced by the event, preferring
+// the RFC 7986 IMAGE property over ATTACH. Inline binary images are ignored.
+func imageURL(event *ics.VEvent) string {
+	for _, name := range []ics.ComponentProperty{"IMAGE", ics.ComponentPropertyAttach} {
+		for _, prop := range event.GetProperties(name) {
+			if v, ok := prop.ICalParameters[string(ics.ParameterValue)]; ok && len(v) > 0 && strings.EqualFold(v[0], "BINARY") {
+				continue
+			}
+			url := strings.TrimSpace(prop.Value)
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				continue
+			}
+			fmtType, ok := prop.ICalParameters[string(ics.ParameterFmttype)]
+			switch {
+			case name == "IMAGE":
+			case ok && len(fmtType) > 0:
+				if !strings.HasPrefix(strings.ToLower(fmtType[0]), "image/") {
+					continue
+				}
+			default:
+				path, _, _ := strings.Cut(strings.ToLower(url), "?")
+				if !slices.ContainsFunc(imageExtensions, func(ext string) bool { return strings.HasSuffix(path, ext) }) {
+					continue
+				}
+			}
+			return url
+		}
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package events
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// parseEvent parses a calendar with a single VEVENT made of the lines
+func parseEvent(t *testing.T, lines ...string) Event {
+	t.Helper()
+	feed := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nBEGIN:VEVENT\r\nUID:1\r\nDTSTAMP:20260101T000000Z\r\nDTSTART:20260101T180000Z\r\nDTEND:20260101T190000Z\r\n" +
+		strings.Join(lines, "\r\n") + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	cal, err := ParseCalendar(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cal.Events()) != 1 {
+		t.Fatalf("parsed %d events, want 1", len(cal.Events()))
+	}
+	var event Event
+	if err := event.ParseFromiCal(cal.Events()[0]); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestParseFromiCalUnescapesText(t *testing.T) {
+	event := parseEvent(t,
+		`SUMMARY:Dir C:\\new\, again`,
+		`DESCRIPTION:Bring C:\\temp\; and snacks\nSee you there`,
+		`LOCATION:Room\\n1`,
+	)
+	if want := `Dir C:\new, again`; event.Name != want {
+		t.Errorf("name %q, want %q", event.Name, want)
+	}
+	if want := "Bring C:\\temp; and snacks\nSee you there"; event.Description != want {
+		t.Errorf("description %q, want %q", event.Description, want)
+	}
+	if want := `Room\n1`; event.Location != want {
+		t.Errorf("location %q, want %q", event.Location, want)
+	}
+}
+
+func TestParseFromiCalCategories(t *testing.T) {
+	event := parseEvent(t, `SUMMARY:Meetup`, `CATEGORIES:Talks\, Demos,C:\\games, Social`)
+	if want := []string{"Talks, Demos", `C:\games`, "Social"}; !slices.Equal(event.Categories, want) {
+		t.Errorf("categories %q, want %q", event.Categories, want)
+	}
+}
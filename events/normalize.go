@@ -0,0 +1,228 @@
+package events
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Discord rejects scheduled events with longer fields than these
+const (
+	MaxNameLength        = 100
+	MaxDescriptionLength = 1000
+	MaxLocationLength    = 100
+)
+
+var (
+	// htmlTag finds something that looks like an opening or closing tag, feeds
+	// rarely mark up their descriptions as HTML so this is used to sniff it
+	htmlTag = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z0-9]*(\s[^<>]*)?/?>`)
+	// blankLines collapses the runs of newlines block elements leave behind
+	blankLines = regexp.MustCompile(`\n[ \t]*\n(\s*\n)+`)
+	// markdownSpecial are the characters Discord would otherwise treat as
+	// formatting in text taken from HTML
+	markdownSpecial = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `_`, `\_`, `~`, `\~`, "`", "\\`", `|`, `\|`)
+)
+
+// looksLikeHTML reports whether s contains HTML tags
+func looksLikeHTML(s string) bool {
+	return htmlTag.MatchString(s)
+}
+
+// HTMLToMarkdown converts an HTML fragment into the subset of Markdown
+// Discord renders. Formatting Discord has no equivalent for is dropped,
+// keeping just the text.
+func HTMLToMarkdown(src string) string {
+	var b strings.Builder
+	z := html.NewTokenizer(strings.NewReader(src))
+	// hrefs holds the href of each open <a> so the link can be written once
+	// its text is known, with the text written so far saved in linkText
+	var hrefs []string
+	var linkText []string
+	skip, pre := 0, 0
+	write := func(s string) {
+		if len(hrefs) > 0 {
+			linkText[len(linkText)-1] += s
+			return
+		}
+		b.WriteString(s)
+	}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		tok := z.Token()
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			text := tok.Data
+			if pre == 0 {
+				text = strings.Join(strings.FieldsFunc(text, unicode.IsSpace), " ")
+				if strings.TrimSpace(tok.Data) != "" {
+					if unicode.IsSpace(rune(tok.Data[0])) {
+						text = " " + text
+					}
+					if unicode.IsSpace(rune(tok.Data[len(tok.Data)-1])) {
+						text += " "
+					}
+				} else if tok.Data != "" {
+					text = " "
+				}
+				text = markdownSpecial.Replace(text)
+			}
+			write(text)
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case atom.Br:
+				write("\n")
+			case atom.P, atom.Div, atom.Table, atom.Tr, atom.Ul, atom.Ol, atom.Blockquote:
+				write("\n\n")
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				write("\n\n**")
+			case atom.Li:
+				write("\n- ")
+			case atom.Td, atom.Th:
+				write(" ")
+			case atom.B, atom.Strong:
+				write("**")
+			case atom.I, atom.Em:
+				write("*")
+			case atom.U:
+				write("__")
+			case atom.S, atom.Strike, atom.Del:
+				write("~~")
+			case atom.Code:
+				if pre == 0 {
+					write("`")
+				}
+			case atom.Pre:
+				pre++
+				write("\n```\n")
+			case atom.Hr:
+				write("\n\n---\n\n")
+			case atom.A:
+				if tt == html.SelfClosingTagToken {
+					continue
+				}
+				href := ""
+				for _, attr := range tok.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+				hrefs = append(hrefs, href)
+				linkText = append(linkText, "")
+			}
+		case html.EndTagToken:
+			switch tok.DataAtom {
+			case atom.Script, atom.Style, atom.Head, atom.Title:
+				skip = max(0, skip-1)
+			case atom.P, atom.Div, atom.Table, atom.Tr, atom.Ul, atom.Ol, atom.Blockquote:
+				write("\n\n")
+			case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+				write("**\n\n")
+			case atom.B, atom.Strong:
+				write("**")
+			case atom.I, atom.Em:
+				write("*")
+			case atom.U:
+				write("__")
+			case atom.S, atom.Strike, atom.Del:
+				write("~~")
+			case atom.Code:
+				if pre == 0 {
+					write("`")
+				}
+			case atom.Pre:
+				pre = max(0, pre-1)
+				write("\n```\n")
+			case atom.A:
+				if len(hrefs) == 0 {
+					continue
+				}
+				href, text := hrefs[len(hrefs)-1], strings.TrimSpace(linkText[len(linkText)-1])
+				hrefs, linkText = hrefs[:len(hrefs)-1], linkText[:len(linkText)-1]
+				write(markdownLink(text, href))
+			}
+		}
+	}
+	// Close any links left open by malformed markup
+	for len(hrefs) > 0 {
+		href, text := hrefs[len(hrefs)-1], strings.TrimSpace(linkText[len(linkText)-1])
+		hrefs, linkText = hrefs[:len(hrefs)-1], linkText[:len(linkText)-1]
+		write(markdownLink(text, href))
+	}
+	out := blankLines.ReplaceAllString(b.String(), "\n\n")
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// markdownLink renders a link, dropping hrefs Discord won't link such as
+// mailto: and javascript: ones and avoiding a link whose text is its address
+func markdownLink(text, href string) string {
+	if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+		return text
+	}
+	if text == "" || text == markdownSpecial.Replace(href) {
+		return "<" + href + ">"
+	}
+	return "[" + text + "](<" + href + ">)"
+}
+
+// ForDiscord fits the event within the lengths Discord accepts for scheduled
+// events. Truncated descriptions end with a link to the event's URL, when it
+// has one, so the full details are a click away.
+func (e Event) ForDiscord() Event {
+	e.Name = truncateText(e.Name, MaxNameLength, "")
+	e.Location = truncateText(e.Location, MaxLocationLength, "")
+	moreInfo := ""
+	if strings.HasPrefix(e.URL, "http://") || strings.HasPrefix(e.URL, "https://") {
+		moreInfo = "\n\n[More info](<" + e.URL + ">)"
+	}
+	e.Description = truncateText(e.Description, MaxDescriptionLength, moreInfo)
+	return e
+}
+
+// truncateText shortens s to at most n runes including the ellipsis and
+// suffix that mark the cut, preferring to break between words and never
+// leaving half of a Markdown link behind.
+func truncateText(s string, n int, suffix string) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	budget := n - len([]rune(suffix)) - 1
+	if budget <= 0 {
+		return string(r[:n-1]) + "…"
+	}
+	cut := budget
+	for i := budget; i > budget/2; i-- {
+		if unicode.IsSpace(r[i]) {
+			cut = i
+			break
+		}
+	}
+	text := string(r[:cut])
+	// A '[' that hasn't been closed by a "](...)" yet starts a link that would
+	// be cut in half, as does a '<' around a bare link
+	if open := strings.LastIndex(text, "["); open >= 0 && !strings.Contains(text[open:], ")") {
+		text = text[:open]
+	}
+	if open := strings.LastIndex(text, "<http"); open >= 0 && !strings.Contains(text[open:], ">") {
+		text = text[:open]
+	}
+	return strings.TrimRightFunc(text, unicode.IsSpace) + "…" + suffix
+}
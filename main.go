@@ -3,6 +3,8 @@ package main
 import (
 	"log/slog"
 	"os"
+	// The container image has no zoneinfo, embed it for guild timezones
+	_ "time/tzdata"
 
 	bot "git.phlcode.club/discord-bot/bot"
 	"git.phlcode.club/discord-bot/database"
@@ -12,7 +14,7 @@ import (
 func main() {
 	utils.InitEnv()
 	e := utils.GetEnv()
-	db, err := database.InitDatabase(e.DBPath)
+	db, err := database.InitDatabase(e.DBDriver, e.DBDSN)
 	if err != nil {
 		slog.Error("error initializing DB connection", slog.Any("error", err))
 		os.Exit(66)
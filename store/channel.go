@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// ChannelRule hosts a calendar's events whose location matches the pattern in
+// a voice or stage channel rather than at an external location
+type ChannelRule struct {
+	ID          int64
+	URL         string
+	PatternType PatternType
+	Pattern     string
+	ChannelID   string
+	expr        Expr
+}
+
+// NewChannelRule compiles the location pattern, which ignores case.
+func NewChannelRule(url, patternType, pattern, channelID string) (*ChannelRule, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("missing location pattern")
+	}
+	if channelID == "" {
+		return nil, fmt.Errorf("missing channel")
+	}
+	expression, err := FieldExpression(FilterFieldLocation, patternType, pattern)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := ParseExpr(expression, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ChannelRule{URL: url, PatternType: patternType, Pattern: pattern, ChannelID: channelID, expr: expr}, nil
+}
+
+func (r ChannelRule) String() string {
+	return fmt.Sprintf("location %s %s → <#%s>", r.PatternType, Quote(r.Pattern), r.ChannelID)
+}
+
+// ChannelRules are all of the channel rules attached to a calendar
+type ChannelRules []ChannelRule
+
+// Channel returns the channel the event should be hosted in, decided by the
+// first rule matching its location, or "" if none do.
+func (rs ChannelRules) Channel(event events.Event) string {
+	for _, r := range rs {
+		if r.expr.Eval(event, nil) {
+			return r.ChannelID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,605 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// Filter expressions combine field comparisons with AND, OR and NOT, e.g.
+//
+//	name contains "Workshop" AND NOT location = "Online"
+//	(name ~ "^CS[0-9]+" OR description contains seminar) AND location != TBD
+//
+// Comparisons take the form `field operator value` where value is either a
+// double quoted string or a single word. Inside quotes `\"` and `\\` are the
+// only escapes, any other backslash is kept as is so regexes like "\d+" can be
+// written without doubling up. The operators are:
+//
+//	=         equal
+//	!=        not equal
+//	contains  substring
+//	glob      matches the whole value, `*` matching any run of characters
+//	          and `?` any single character
+//	~         matches the regex
+//	!~        does not match the regex
+//
+// Whether text comparisons ignore case is a property of the filter rather
+// than the expression, see ParseExpr. Values are limited to 200 characters and
+// regexes that compile into overly large programs are rejected.
+//
+// Text comparisons are available for name, description, location, categories,
+// organizer, url and status. An event has a value for categories per category
+// and matches if any of them do.
+//
+// The time based fields compare the event's start in the guild's timezone:
+//
+//	weekday   =, != or in, e.g. `weekday in sat, sun`
+//	time      start time of day, e.g. `time >= 18:00 AND time < 22:00`
+//	duration  length of the event, e.g. `duration <= 2h30m`
+//	date      start date, e.g. `date >= 2026-01-01`
+//
+// and support =, !=, <, <=, > and >= except for weekday.
+//
+// NOT binds tighter than AND, which binds tighter than OR. Keywords and
+// operator words (contains, glob, in) are case insensitive.
+
+const (
+	// maxExpressionLength keeps stored filters reasonably sized
+	maxExpressionLength = 1000
+	// maxExpressionDepth guards the recursive descent parser against deeply
+	// nested input
+	maxExpressionDepth = 32
+)
+
+// Expr is a parsed filter expression
+type Expr interface {
+	// Eval reports whether the event satisfies the expression, with loc being
+	// the timezone time based fields are evaluated in
+	Eval(event events.Event, loc *time.Location) bool
+	// String returns the expression in its canonical form, which parses back
+	// into the same expression
+	String() string
+}
+
+// SyntaxError describes why a filter expression could not be parsed
+type SyntaxError struct {
+	// Pos is the 1 based column the error was found at
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at column %d: %s", e.Pos, e.Msg)
+}
+
+type andExpr struct{ left, right Expr }
+
+func (e andExpr) Eval(event events.Event, loc *time.Location) bool {
+	return e.left.Eval(event, loc) && e.right.Eval(event, loc)
+}
+func (e andExpr) String() string { return parenOr(e.left) + " AND " + parenOr(e.right) }
+
+type orExpr struct{ left, right Expr }
+
+func (e orExpr) Eval(event events.Event, loc *time.Location) bool {
+	return e.left.Eval(event, loc) || e.right.Eval(event, loc)
+}
+func (e orExpr) String() string { return e.left.String() + " OR " + e.right.String() }
+
+type notExpr struct{ x Expr }
+
+func (e notExpr) Eval(event events.Event, loc *time.Location) bool { return !e.x.Eval(event, loc) }
+func (e notExpr) String() string {
+	switch e.x.(type) {
+	case andExpr, orExpr:
+		return "NOT (" + e.x.String() + ")"
+	}
+	return "NOT " + e.x.String()
+}
+
+// parenOr wraps OR expressions in parentheses so the canonical form of an AND
+// keeps the original precedence
+func parenOr(x Expr) string {
+	if _, ok := x.(orExpr); ok {
+		return "(" + x.String() + ")"
+	}
+	return x.String()
+}
+
+type compareExpr struct {
+	field FilterField
+	op    string
+	value string
+	// fold is set when the comparison ignores case
+	fold bool
+	// re is the compiled regex for ~, !~ and glob
+	re *regexp.Regexp
+}
+
+func (e compareExpr) Eval(event events.Event, _ *time.Location) bool {
+	// Negated operators hold when none of the field's values match, so an
+	// event with the categories "a, b" is not `categories != a`
+	switch e.op {
+	case "!=":
+		return !e.any(event, "=")
+	case "!~":
+		return !e.any(event, "~")
+	}
+	return e.any(event, e.op)
+}
+
+// any reports whether any of the event's values for the field satisfy op
+func (e compareExpr) any(event events.Event, op string) bool {
+	for _, against := range fieldValues(event, e.field) {
+		var ok bool
+		switch op {
+		case "=":
+			ok = against == e.value || e.fold && strings.EqualFold(against, e.value)
+		case "contains":
+			if e.fold {
+				ok = strings.Contains(strings.ToLower(against), strings.ToLower(e.value))
+			} else {
+				ok = strings.Contains(against, e.value)
+			}
+		case "~", "glob":
+			ok = e.re.MatchString(against)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e compareExpr) String() string {
+	return e.field + " " + e.op + " " + Quote(e.value)
+}
+
+// fieldValues returns the text of the event's field. Every field has a single
+// value except for categories.
+func fieldValues(event events.Event, field FilterField) []string {
+	switch field {
+	case FilterFieldName:
+		return []string{event.Name}
+	case FilterFieldDescription:
+		return []string{event.Description}
+	case FilterFieldLocation:
+		return []string{event.Location}
+	case FilterFieldCategories:
+		if len(event.Categories) == 0 {
+			return []string{""}
+		}
+		return event.Categories
+	case FilterFieldOrganizer:
+		return []string{event.Organizer}
+	case FilterFieldURL:
+		return []string{event.URL}
+	case FilterFieldStatus:
+		return []string{event.Status}
+	}
+	return []string{""}
+}
+
+// Quote renders s as a double quoted expression value
+func Quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// ParseExpr parses a filter expression, returning a *SyntaxError describing
+// the first problem found if it is invalid. When ignoreCase is set every text
+// comparison in the expression ignores case, including regexes.
+func ParseExpr(src string, ignoreCase bool) (Expr, error) {
+	if len(src) > maxExpressionLength {
+		return nil, &SyntaxError{Pos: maxExpressionLength, Msg: fmt.Sprintf("expression is longer than %d characters", maxExpressionLength)}
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{toks: toks, fold: ignoreCase}
+	x, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+	return x, nil
+}
+
+// wordBreaks end an unquoted word
+const wordBreaks = `()"=~!<>`
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return Quote(t.text)
+	}
+	return "`" + t.text + "`"
+}
+
+// isKeyword reports whether the token is the given case insensitive keyword
+func (t token) isKeyword(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+func lex(src string) ([]token, error) {
+	toks := make([]token, 0)
+	r := []rune(src)
+	for i := 0; i < len(r); {
+		c := r[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, text: "(", pos: pos})
+			i++
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, text: ")", pos: pos})
+			i++
+		case c == '=' || c == '~':
+			toks = append(toks, token{kind: tokOp, text: string(c), pos: pos})
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(r) && r[i+1] == '=' {
+				toks = append(toks, token{kind: tokOp, text: string(r[i : i+2]), pos: pos})
+				i += 2
+				break
+			}
+			toks = append(toks, token{kind: tokOp, text: string(c), pos: pos})
+			i++
+		case c == '!':
+			if i+1 >= len(r) || (r[i+1] != '=' && r[i+1] != '~') {
+				return nil, &SyntaxError{Pos: pos, Msg: "expected `!=` or `!~`, use NOT to negate an expression"}
+			}
+			toks = append(toks, token{kind: tokOp, text: string(r[i : i+2]), pos: pos})
+			i += 2
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(r) && r[i] != '"'; i++ {
+				if r[i] == '\\' && i+1 < len(r) && (r[i+1] == '"' || r[i+1] == '\\') {
+					i++
+				}
+				b.WriteRune(r[i])
+			}
+			if i >= len(r) {
+				return nil, &SyntaxError{Pos: pos, Msg: "unterminated string"}
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: b.String(), pos: pos})
+		default:
+			start := i
+			for i < len(r) && !unicode.IsSpace(r[i]) && !strings.ContainsRune(wordBreaks, r[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokWord, text: string(r[start:i]), pos: pos})
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(r) + 1}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	fold bool
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr(depth int) (Expr, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (Expr, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("AND") {
+		p.next()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (Expr, error) {
+	if depth > maxExpressionDepth {
+		return nil, &SyntaxError{Pos: p.peek().pos, Msg: "expression is nested too deeply"}
+	}
+	t := p.peek()
+	switch {
+	case t.isKeyword("NOT"):
+		p.next()
+		x, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	case t.kind == tokLParen:
+		p.next()
+		x, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, &SyntaxError{Pos: closing.pos, Msg: fmt.Sprintf("expected `)` to close `(` at column %d but found %s", t.pos, closing)}
+		}
+		return x, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokWord {
+		return nil, &SyntaxError{Pos: fieldTok.pos, Msg: fmt.Sprintf("expected a field name but found %s", fieldTok)}
+	}
+	field := strings.ToLower(fieldTok.text)
+	if !isFilterField(field) {
+		return nil, &SyntaxError{Pos: fieldTok.pos, Msg: fmt.Sprintf("unknown field %s, expected one of %s", fieldTok, strings.Join(filterFields, ", "))}
+	}
+
+	opTok := p.next()
+	op := opTok.text
+	switch {
+	case opTok.kind == tokOp:
+	case opTok.isKeyword("contains"):
+		op = "contains"
+	case opTok.isKeyword("glob"):
+		op = "glob"
+	case opTok.isKeyword("in"):
+		op = "in"
+	default:
+		return nil, &SyntaxError{Pos: opTok.pos, Msg: fmt.Sprintf("expected an operator (%s) after %s but found %s", strings.Join(fieldOperators(field), ", "), fieldTok, opTok)}
+	}
+	if !slices.Contains(fieldOperators(field), op) {
+		return nil, &SyntaxError{Pos: opTok.pos, Msg: fmt.Sprintf("%s can't be used with %s, expected one of %s", opTok, fieldTok, strings.Join(fieldOperators(field), ", "))}
+	}
+
+	valueTok := p.next()
+	if valueTok.kind != tokString && valueTok.kind != tokWord {
+		return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("expected a value after %s but found %s", opTok, valueTok)}
+	}
+	switch field {
+	case FilterFieldWeekday:
+		return newWeekdayExpr(op, p.listValue(valueTok))
+	case FilterFieldTime, FilterFieldDuration, FilterFieldDate:
+		return newOrderedExpr(field, op, valueTok)
+	}
+	x := compareExpr{field: field, op: op, value: valueTok.text, fold: p.fold}
+	if len(x.value) > maxPatternLength {
+		return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("value is longer than %d characters", maxPatternLength)}
+	}
+	var err error
+	switch op {
+	case "~", "!~":
+		x.re, err = compilePattern(x.value, p.fold)
+		if err != nil {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("invalid regex %s: %s", Quote(x.value), err)}
+		}
+	case "glob":
+		x.re, err = compilePattern(globRegex(x.value), p.fold)
+		if err != nil {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("invalid glob %s: %s", Quote(x.value), err)}
+		}
+	}
+	return x, nil
+}
+
+// listValue extends an unquoted comma separated list over the words that
+// follow it, so the list can have spaces around its commas as in `sat, sun`
+func (p *parser) listValue(value token) token {
+	for value.kind == tokWord && p.peek().kind == tokWord &&
+		(strings.HasSuffix(value.text, ",") || strings.HasPrefix(p.peek().text, ",")) {
+		value.text += p.next().text
+	}
+	return value
+}
+
+// fieldOperators lists the operators the field can be compared with
+func fieldOperators(field FilterField) []string {
+	switch field {
+	case FilterFieldWeekday:
+		return []string{"=", "!=", "in"}
+	case FilterFieldTime, FilterFieldDuration, FilterFieldDate:
+		return []string{"=", "!=", "<", "<=", ">", ">="}
+	}
+	return []string{"=", "!=", "~", "!~", "contains", "glob"}
+}
+
+// formatValue renders a value as a bare word when it can be lexed back as one
+// and quotes it otherwise
+func formatValue(v string) string {
+	if v == "" || strings.ContainsFunc(v, func(r rune) bool { return unicode.IsSpace(r) || strings.ContainsRune(wordBreaks, r) }) {
+		return Quote(v)
+	}
+	for _, kw := range []string{"AND", "OR", "NOT"} {
+		if strings.EqualFold(v, kw) {
+			return Quote(v)
+		}
+	}
+	return v
+}
+
+// weekdayExpr matches the day of the week the event starts on
+type weekdayExpr struct {
+	op    string
+	value string
+	days  []time.Weekday
+}
+
+func newWeekdayExpr(op string, valueTok token) (Expr, error) {
+	x := weekdayExpr{op: op, value: valueTok.text}
+	for _, name := range strings.Split(valueTok.text, ",") {
+		day, ok := parseWeekday(strings.TrimSpace(name))
+		if !ok {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("unknown weekday %q, expected e.g. mon or monday", name)}
+		}
+		x.days = append(x.days, day)
+	}
+	if op != "in" && len(x.days) > 1 {
+		return nil, &SyntaxError{Pos: valueTok.pos, Msg: "use `in` to compare against several weekdays"}
+	}
+	return x, nil
+}
+
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if name == full || name == full[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func (e weekdayExpr) Eval(event events.Event, loc *time.Location) bool {
+	in := slices.Contains(e.days, event.StartTime.In(loc).Weekday())
+	if e.op == "!=" {
+		return !in
+	}
+	return in
+}
+
+func (e weekdayExpr) String() string {
+	return FilterFieldWeekday + " " + e.op + " " + formatValue(e.value)
+}
+
+// orderedExpr compares a time based field that can be reduced to a number:
+// minutes since midnight for time, nanoseconds for duration and YYYYMMDD for
+// date.
+type orderedExpr struct {
+	field FilterField
+	op    string
+	value string
+	n     int64
+}
+
+func newOrderedExpr(field FilterField, op string, valueTok token) (Expr, error) {
+	x := orderedExpr{field: field, op: op, value: valueTok.text}
+	switch field {
+	case FilterFieldTime:
+		t, err := parseTimeOfDay(valueTok.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("invalid time %q, expected e.g. 18:00 or 6:30pm", valueTok.text)}
+		}
+		x.n = int64(t.Hour()*60 + t.Minute())
+	case FilterFieldDuration:
+		d, err := time.ParseDuration(valueTok.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("invalid duration %q, expected e.g. 90m or 1h30m", valueTok.text)}
+		}
+		x.n = int64(d)
+	case FilterFieldDate:
+		d, err := time.Parse("2006-01-02", valueTok.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: valueTok.pos, Msg: fmt.Sprintf("invalid date %q, expected YYYY-MM-DD", valueTok.text)}
+		}
+		x.n = dateNumber(d)
+	}
+	return x, nil
+}
+
+func parseTimeOfDay(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{"15:04", "3:04pm", "3pm"} {
+		var t time.Time
+		t, err = time.Parse(layout, strings.ToLower(value))
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+func dateNumber(t time.Time) int64 {
+	return int64(t.Year()*10000 + int(t.Month())*100 + t.Day())
+}
+
+func (e orderedExpr) Eval(event events.Event, loc *time.Location) bool {
+	var n int64
+	start := event.StartTime.In(loc)
+	switch e.field {
+	case FilterFieldTime:
+		n = int64(start.Hour()*60 + start.Minute())
+	case FilterFieldDuration:
+		if !event.EndTime.IsZero() {
+			n = int64(event.EndTime.Sub(event.StartTime))
+		}
+	case FilterFieldDate:
+		n = dateNumber(start)
+	}
+	switch e.op {
+	case "=":
+		return n == e.n
+	case "!=":
+		return n != e.n
+	case "<":
+		return n < e.n
+	case "<=":
+		return n <= e.n
+	case ">":
+		return n > e.n
+	case ">=":
+		return n >= e.n
+	}
+	return false
+}
+
+func (e orderedExpr) String() string {
+	return e.field + " " + e.op + " " + formatValue(e.value)
+}
@@ -0,0 +1,623 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for exercising the
+// calendar commands without a database. It enforces the same uniqueness the
+// database schema does.
+type MemoryStore struct {
+	mu   *sync.Mutex
+	data *memoryData
+}
+
+type memoryCalendar struct {
+	guildID    string
+	name       string
+	lastSynced time.Time
+	polledAt   time.Time
+	cover      string
+}
+
+type memoryEvent struct {
+	url   string
+	event events.Event
+}
+
+type memoryData struct {
+	calendars map[string]memoryCalendar
+	// events are kept in insertion order like the database's rows
+	events       []memoryEvent
+	filters      []Filter
+	rewriteRules []RewriteRule
+	channelRules []ChannelRule
+	settings     map[string]CalendarSettings
+	timezones    map[string]*time.Location
+	batches      []OpBatch
+	ops          []Op
+	lastID       int64
+}
+
+func NewMemoryStore() Store {
+	return MemoryStore{
+		mu: &sync.Mutex{},
+		data: &memoryData{
+			calendars: make(map[string]memoryCalendar),
+			settings:  make(map[string]CalendarSettings),
+			timezones: make(map[string]*time.Location),
+		},
+	}
+}
+
+func (d *memoryData) clone() *memoryData {
+	return &memoryData{
+		calendars:    maps.Clone(d.calendars),
+		events:       slices.Clone(d.events),
+		filters:      slices.Clone(d.filters),
+		rewriteRules: slices.Clone(d.rewriteRules),
+		channelRules: slices.Clone(d.channelRules),
+		settings:     maps.Clone(d.settings),
+		timezones:    maps.Clone(d.timezones),
+		batches:      slices.Clone(d.batches),
+		ops:          slices.Clone(d.ops),
+		lastID:       d.lastID,
+	}
+}
+
+func (d *memoryData) nextID() int64 {
+	d.lastID++
+	return d.lastID
+}
+
+// WithTx runs fn against a copy of the store's contents that replaces them
+// only if fn succeeds and ctx hasn't been cancelled. The store is locked until
+// fn returns, so fn must only use the store it is given.
+func (m MemoryStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := MemoryStore{mu: &sync.Mutex{}, data: m.data.clone()}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	*m.data = *tx.data
+	return nil
+}
+
+func (m MemoryStore) InsertCalendar(ctx context.Context, url, guildID, name string, filters Filters) (Filters, error) {
+	stored := make(Filters, 0, len(filters))
+	err := m.WithTx(ctx, func(tx Store) error {
+		t := tx.(MemoryStore)
+		if _, ok := t.data.calendars[url]; ok {
+			return fmt.Errorf("calendar %s already exists", url)
+		}
+		t.data.calendars[url] = memoryCalendar{guildID: guildID, name: name, lastSynced: time.Now().UTC()}
+		for _, filter := range filters {
+			filter.URL = url
+			created, err := t.CreateFilter(ctx, filter)
+			if err != nil {
+				return fmt.Errorf("unable to store filter %s: %w", filter.Expr, err)
+			}
+			stored = append(stored, created)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// memoryResult is the sql.Result of inserting an event
+type memoryResult struct{}
+
+func (memoryResult) LastInsertId() (int64, error) {
+	return 0, fmt.Errorf("events have no numeric id")
+}
+
+func (memoryResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+func (m MemoryStore) InsertEvent(ctx context.Context, url string, e events.Event) (sql.Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[url]; !ok {
+		return nil, fmt.Errorf("calendar %s does not exist", url)
+	}
+	for _, stored := range m.data.events {
+		if stored.event.ID == e.ID {
+			return nil, fmt.Errorf("event %s already exists", e.ID)
+		}
+	}
+	m.data.events = append(m.data.events, memoryEvent{url: url, event: e})
+	return memoryResult{}, nil
+}
+
+// calendar builds the Calendar for url. The caller must hold mu.
+func (m MemoryStore) calendar(url string, now time.Time) Calendar {
+	stored := m.data.calendars[url]
+	cal := Calendar{
+		URL:        url,
+		GuildID:    stored.guildID,
+		Name:       stored.name,
+		LastSynced: stored.lastSynced,
+		Filters:    make(Filters, 0),
+		Settings:   DefaultCalendarSettings(url),
+	}
+	for _, e := range m.data.events {
+		if e.url == url && !e.event.EndTime.Before(now) && !e.event.ManuallyRemoved {
+			cal.EventCount++
+		}
+	}
+	for _, filter := range m.data.filters {
+		if filter.URL == url {
+			cal.Filters = append(cal.Filters, filter)
+		}
+	}
+	if settings, ok := m.data.settings[url]; ok {
+		cal.Settings = settings
+	}
+	return cal
+}
+
+func (m MemoryStore) GetCalendar(ctx context.Context, url string) (Calendar, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[url]; !ok {
+		return Calendar{}, ErrCalendarNotFound
+	}
+	return m.calendar(url, time.Now()), nil
+}
+
+// LockCalendar only checks the calendar exists, transactions already hold the
+// whole store
+func (m MemoryStore) LockCalendar(ctx context.Context, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[url]; !ok {
+		return ErrCalendarNotFound
+	}
+	return nil
+}
+
+func (m MemoryStore) UpdateLastSynced(ctx context.Context, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cal, ok := m.data.calendars[url]; ok {
+		cal.lastSynced = time.Now().UTC()
+		m.data.calendars[url] = cal
+	}
+	return nil
+}
+
+func (m MemoryStore) ClaimCalendarPolls(ctx context.Context, since time.Time) ([]Calendar, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().UTC()
+	calendars := make([]Calendar, 0)
+	for url, cal := range m.data.calendars {
+		if cal.guildID == "" || !cal.polledAt.IsZero() && !cal.polledAt.Before(since) {
+			continue
+		}
+		cal.polledAt = now
+		m.data.calendars[url] = cal
+		calendars = append(calendars, Calendar{URL: url, GuildID: cal.guildID})
+	}
+	slices.SortFunc(calendars, func(a, b Calendar) int { return strings.Compare(a.URL, b.URL) })
+	return calendars, nil
+}
+
+func (m MemoryStore) SetCalendarGuild(ctx context.Context, url, guildID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cal, ok := m.data.calendars[url]; ok {
+		cal.guildID = guildID
+		m.data.calendars[url] = cal
+	}
+	return nil
+}
+
+func (m MemoryStore) GetCalendarCover(ctx context.Context, url string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cal, ok := m.data.calendars[url]
+	if !ok {
+		return "", ErrCalendarNotFound
+	}
+	return cal.cover, nil
+}
+
+func (m MemoryStore) SetCalendarCover(ctx context.Context, url, cover string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cal, ok := m.data.calendars[url]; ok {
+		cal.cover = cover
+		m.data.calendars[url] = cal
+	}
+	return nil
+}
+
+func (m MemoryStore) GetCalendarSettings(ctx context.Context, url string) (CalendarSettings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if settings, ok := m.data.settings[url]; ok {
+		return settings, nil
+	}
+	return DefaultCalendarSettings(url), nil
+}
+
+func (m MemoryStore) SetCalendarSettings(ctx context.Context, settings CalendarSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[settings.URL]; !ok {
+		return fmt.Errorf("calendar %s does not exist", settings.URL)
+	}
+	settings.DefaultDuration = settings.DefaultDuration.Truncate(time.Minute)
+	m.data.settings[settings.URL] = settings
+	return nil
+}
+
+func (m MemoryStore) GetGuildTimezone(ctx context.Context, guildID string) (*time.Location, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if loc, ok := m.data.timezones[guildID]; ok {
+		return loc, nil
+	}
+	return time.UTC, nil
+}
+
+func (m MemoryStore) SetGuildTimezone(ctx context.Context, guildID string, loc *time.Location) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.timezones[guildID] = loc
+	return nil
+}
+
+func (m MemoryStore) DeleteCalendar(ctx context.Context, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.events = slices.DeleteFunc(m.data.events, func(e memoryEvent) bool { return e.url == url })
+	m.data.filters = slices.DeleteFunc(m.data.filters, func(f Filter) bool { return f.URL == url })
+	m.data.rewriteRules = slices.DeleteFunc(m.data.rewriteRules, func(r RewriteRule) bool { return r.URL == url })
+	m.data.channelRules = slices.DeleteFunc(m.data.channelRules, func(r ChannelRule) bool { return r.URL == url })
+	delete(m.data.settings, url)
+	delete(m.data.calendars, url)
+	return nil
+}
+
+func (m MemoryStore) DeleteEventsByIDs(ctx context.Context, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data.events = slices.DeleteFunc(m.data.events, func(e memoryEvent) bool {
+		return slices.Contains(ids, e.event.ID)
+	})
+	return nil
+}
+
+func (m MemoryStore) GetEventsForURL(ctx context.Context, url string) ([]events.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	evts := make([]events.Event, 0)
+	for _, e := range m.data.events {
+		if e.url == url {
+			evts = append(evts, e.event)
+		}
+	}
+	return evts, nil
+}
+
+func (m MemoryStore) GetEventsInRange(ctx context.Context, guildID, url string, from, to time.Time) ([]events.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	evts := make([]events.Event, 0)
+	for _, e := range m.data.events {
+		switch {
+		case m.data.calendars[e.url].guildID != guildID,
+			url != "" && e.url != url,
+			e.event.EndTime.Before(from),
+			!to.IsZero() && !e.event.StartTime.Before(to),
+			e.event.ManuallyRemoved:
+			continue
+		}
+		evts = append(evts, e.event)
+	}
+	slices.SortStableFunc(evts, func(a, b events.Event) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+	return evts, nil
+}
+
+func (m MemoryStore) GetCalendars(ctx context.Context, guildID string) ([]Calendar, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	calendars := make([]Calendar, 0)
+	for url, cal := range m.data.calendars {
+		if cal.guildID == guildID {
+			calendars = append(calendars, m.calendar(url, now))
+		}
+	}
+	slices.SortFunc(calendars, func(a, b Calendar) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.URL, b.URL)
+	})
+	return calendars, nil
+}
+
+func (m MemoryStore) GetFiltersForURL(ctx context.Context, url string) (Filters, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	filters := make(Filters, 0)
+	for _, filter := range m.data.filters {
+		if filter.URL == url {
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+func (m MemoryStore) CreateFilter(ctx context.Context, filter Filter) (Filter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[filter.URL]; !ok {
+		return Filter{}, fmt.Errorf("calendar %s does not exist", filter.URL)
+	}
+	for _, stored := range m.data.filters {
+		if stored.URL == filter.URL && stored.Mode == filter.Mode && stored.IgnoreCase == filter.IgnoreCase &&
+			stored.Expr.String() == filter.Expr.String() {
+			return Filter{}, fmt.Errorf("filter %s already exists", filter.Expr)
+		}
+	}
+	filter.ID = m.data.nextID()
+	m.data.filters = append(m.data.filters, filter)
+	return filter, nil
+}
+
+func (m MemoryStore) DeleteFilter(ctx context.Context, url string, id int64) (Filter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.data.filters, func(f Filter) bool { return f.URL == url && f.ID == id })
+	if i < 0 {
+		return Filter{}, ErrFilterNotFound
+	}
+	filter := m.data.filters[i]
+	m.data.filters = slices.Delete(m.data.filters, i, i+1)
+	return filter, nil
+}
+
+func (m MemoryStore) UpdateEvent(ctx context.Context, url string, e events.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.data.events {
+		if stored.event.ID == e.ID && stored.url == url {
+			e.ManuallyRemoved, e.EditedFields = stored.event.ManuallyRemoved, stored.event.EditedFields
+			m.data.events[i].event = e
+		}
+	}
+	return nil
+}
+
+func (m MemoryStore) GetEvent(ctx context.Context, id string) (string, events.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range m.data.events {
+		if stored.event.ID == id {
+			return stored.url, stored.event, nil
+		}
+	}
+	return "", events.Event{}, ErrEventNotFound
+}
+
+func (m MemoryStore) MarkEventRemoved(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.data.events {
+		if stored.event.ID == id {
+			m.data.events[i].event.ManuallyRemoved = true
+		}
+	}
+	return nil
+}
+
+func (m MemoryStore) SetEditedFields(ctx context.Context, id string, fields []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.data.events {
+		if stored.event.ID == id {
+			m.data.events[i].event.EditedFields = slices.Clone(fields)
+		}
+	}
+	return nil
+}
+
+func (m MemoryStore) GetRewriteRules(ctx context.Context, url string) (RewriteRules, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules := make(RewriteRules, 0)
+	for _, rule := range m.data.rewriteRules {
+		if rule.URL == url {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (m MemoryStore) CreateRewriteRule(ctx context.Context, rule RewriteRule) (RewriteRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[rule.URL]; !ok {
+		return RewriteRule{}, fmt.Errorf("calendar %s does not exist", rule.URL)
+	}
+	rule.ID = m.data.nextID()
+	m.data.rewriteRules = append(m.data.rewriteRules, rule)
+	return rule, nil
+}
+
+func (m MemoryStore) DeleteRewriteRule(ctx context.Context, url string, id int64) (RewriteRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.data.rewriteRules, func(r RewriteRule) bool { return r.URL == url && r.ID == id })
+	if i < 0 {
+		return RewriteRule{}, ErrRewriteRuleNotFound
+	}
+	rule := m.data.rewriteRules[i]
+	m.data.rewriteRules = slices.Delete(m.data.rewriteRules, i, i+1)
+	return rule, nil
+}
+
+func (m MemoryStore) GetChannelRules(ctx context.Context, url string) (ChannelRules, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules := make(ChannelRules, 0)
+	for _, rule := range m.data.channelRules {
+		if rule.URL == url {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (m MemoryStore) CreateChannelRule(ctx context.Context, rule ChannelRule) (ChannelRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data.calendars[rule.URL]; !ok {
+		return ChannelRule{}, fmt.Errorf("calendar %s does not exist", rule.URL)
+	}
+	rule.ID = m.data.nextID()
+	m.data.channelRules = append(m.data.channelRules, rule)
+	return rule, nil
+}
+
+func (m MemoryStore) DeleteChannelRule(ctx context.Context, url string, id int64) (ChannelRule, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.data.channelRules, func(r ChannelRule) bool { return r.URL == url && r.ID == id })
+	if i < 0 {
+		return ChannelRule{}, ErrChannelRuleNotFound
+	}
+	rule := m.data.channelRules[i]
+	m.data.channelRules = slices.Delete(m.data.channelRules, i, i+1)
+	return rule, nil
+}
+
+func (m MemoryStore) QueueOps(ctx context.Context, batch OpBatch, ops []Op) (OpBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch.ID = m.data.nextID()
+	batch.CreatedAt = time.Now().UTC()
+	m.data.batches = append(m.data.batches, batch)
+	for _, op := range ops {
+		op.ID = m.data.nextID()
+		op.BatchID = batch.ID
+		op.GuildID = batch.GuildID
+		op.URL = batch.URL
+		op.Status = OpPending
+		op.Started = false
+		op.Attempts = 0
+		op.NextAttempt = batch.CreatedAt
+		op.Error = ""
+		op.LeasedUntil = time.Time{}
+		m.data.ops = append(m.data.ops, op)
+	}
+	return batch, nil
+}
+
+func (m MemoryStore) GetPendingOps(ctx context.Context) ([]Op, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]Op, 0)
+	for _, op := range m.data.ops {
+		if op.Status == OpPending {
+			ops = append(ops, op)
+		}
+	}
+	slices.SortStableFunc(ops, func(a, b Op) int {
+		return a.NextAttempt.Compare(b.NextAttempt)
+	})
+	return ops, nil
+}
+
+func (m MemoryStore) GetOps(ctx context.Context, batchID int64) ([]Op, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]Op, 0)
+	for _, op := range m.data.ops {
+		if op.BatchID == batchID {
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+func (m MemoryStore) UpdateOp(ctx context.Context, op Op) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, stored := range m.data.ops {
+		if stored.ID == op.ID {
+			op.BatchID, op.GuildID, op.URL = stored.BatchID, stored.GuildID, stored.URL
+			m.data.ops[i] = op
+		}
+	}
+	return nil
+}
+
+func (m MemoryStore) ClaimOp(ctx context.Context, id int64, until time.Time) (Op, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for i, op := range m.data.ops {
+		if op.ID != id {
+			continue
+		}
+		if op.Status != OpPending || op.NextAttempt.After(now) || op.LeasedUntil.After(now) {
+			return Op{}, false, nil
+		}
+		m.data.ops[i].LeasedUntil = until
+		return m.data.ops[i], true, nil
+	}
+	return Op{}, false, nil
+}
+
+func (m MemoryStore) GetOpBatch(ctx context.Context, id int64) (OpBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.data.batches, func(b OpBatch) bool { return b.ID == id })
+	if i < 0 {
+		return OpBatch{}, ErrOpBatchNotFound
+	}
+	return m.data.batches[i], nil
+}
+
+func (m MemoryStore) GetOpBatches(ctx context.Context) ([]OpBatch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.data.batches), nil
+}
+
+func (m MemoryStore) DeleteOpBatch(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !slices.ContainsFunc(m.data.batches, func(b OpBatch) bool { return b.ID == id }) {
+		return ErrOpBatchNotFound
+	}
+	m.data.ops = slices.DeleteFunc(m.data.ops, func(op Op) bool { return op.BatchID == id })
+	m.data.batches = slices.DeleteFunc(m.data.batches, func(b OpBatch) bool { return b.ID == id })
+	return nil
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"time"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// OpKind is the change a queued operation makes to a guild scheduled event
+type OpKind = string
+
+const (
+	OpCreate OpKind = "create"
+	OpEdit   OpKind = "edit"
+	OpDelete OpKind = "delete"
+)
+
+// OpStatus is how far a queued operation has got
+type OpStatus = string
+
+const (
+	// OpPending operations are still to be made, possibly after a retry delay
+	OpPending OpStatus = "pending"
+	// OpDone operations were made on Discord and recorded in the events table
+	OpDone OpStatus = "done"
+	// OpFailed operations were given up on, Error says why
+	OpFailed OpStatus = "failed"
+)
+
+// BatchAction is what finishing a batch of operations does to its calendar
+type BatchAction = string
+
+const (
+	// BatchSync marks the calendar synced if every operation succeeded
+	BatchSync BatchAction = "sync"
+	// BatchUnsubscribe deletes the calendar if every operation succeeded
+	BatchUnsubscribe BatchAction = "unsubscribe"
+)
+
+// OpBatch groups the operations queued by one command, so their outcome can
+// be reported to the interaction that queued them once they have all finished
+type OpBatch struct {
+	ID      int64
+	Action  BatchAction
+	GuildID string
+	URL     string
+	// ApplicationID, InteractionID and InteractionToken identify the
+	// interaction the outcome is reported to, they are empty for batches not
+	// queued by a command
+	ApplicationID    string
+	InteractionID    string
+	InteractionToken string
+	CreatedAt        time.Time
+	// AwaitedUntil is how long the command that queued the batch waits for
+	// its outcome, zero if nothing is waiting for it. Until then only the
+	// instance running the command finishes the batch.
+	AwaitedUntil time.Time
+}
+
+// Op is a queued change to one of a calendar's guild scheduled events
+type Op struct {
+	ID      int64
+	BatchID int64
+	Kind    OpKind
+	// GuildID and URL are those of the op's batch
+	GuildID string
+	URL     string
+	// Event is the event as it should be on Discord. Its ID is the scheduled
+	// event's, which for creates is only known once they are done.
+	Event  events.Event
+	Status OpStatus
+	// Started is set once a create has been sent to Discord, after which it
+	// may have been made even though it was never recorded as done
+	Started  bool
+	Attempts int
+	// NextAttempt is when the op is next due to be tried
+	NextAttempt time.Time
+	// Error is why the last attempt failed
+	Error string
+	// LeasedUntil is when the instance that claimed the op to make it gives
+	// up its claim, zero when no instance has claimed it
+	LeasedUntil time.Time
+}
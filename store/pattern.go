@@ -0,0 +1,120 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// PatternType is how the pattern of a field and pattern filter is matched
+type PatternType = string
+
+const (
+	PatternSubstring PatternType = "substring"
+	PatternGlob      PatternType = "glob"
+	PatternRegex     PatternType = "regex"
+)
+
+var PatternTypes = []PatternType{PatternSubstring, PatternGlob, PatternRegex}
+
+const (
+	// maxPatternLength limits the length of any text value a field is
+	// compared against
+	maxPatternLength = 200
+	// maxPatternInsts limits the size of the compiled regex program. Go's
+	// regexes run in linear time but a short pattern like `(a{100}){100}`
+	// still compiles into a huge program.
+	maxPatternInsts = 2000
+)
+
+// FieldExpression builds the expression equivalent to matching a single
+// field against a pattern of the given type.
+func FieldExpression(field FilterField, patternType PatternType, pattern string) (string, error) {
+	var op string
+	switch patternType {
+	case PatternSubstring:
+		op = "contains"
+	case PatternGlob:
+		op = "glob"
+	case PatternRegex:
+		op = "~"
+	default:
+		return "", fmt.Errorf("unknown pattern type %q, expected one of %s", patternType, strings.Join(PatternTypes, ", "))
+	}
+	return field + " " + op + " " + Quote(pattern), nil
+}
+
+// compilePattern compiles a regex after checking it is within the size limits,
+// explaining what is wrong with it in terms an admin can act on when it isn't.
+func compilePattern(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	flags := syntax.Perl
+	if ignoreCase {
+		flags |= syntax.FoldCase
+	}
+	re, err := syntax.Parse(pattern, flags)
+	if err != nil {
+		return nil, errors.New(regexErrorMessage(err))
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil || len(prog.Inst) > maxPatternInsts {
+		return nil, errors.New("pattern is too complex, try splitting it into several comparisons joined with OR")
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// regexErrorMessage rewords regex syntax errors, which describe the problem
+// in terms of the regex grammar
+func regexErrorMessage(err error) string {
+	var syntaxErr *syntax.Error
+	if !errors.As(err, &syntaxErr) {
+		return err.Error()
+	}
+	var msg string
+	switch syntaxErr.Code {
+	case syntax.ErrMissingParen:
+		msg = "a `(` is missing its closing `)`"
+	case syntax.ErrUnexpectedParen:
+		msg = "a `)` has no opening `(`"
+	case syntax.ErrMissingBracket:
+		msg = "a `[` is missing its closing `]`"
+	case syntax.ErrMissingRepeatArgument, syntax.ErrInvalidRepeatOp:
+		msg = "`*`, `+` and `?` repeat what comes before them, escape them with `\\` to match them literally"
+	case syntax.ErrInvalidRepeatSize:
+		msg = "repeat counts like `{n}` are limited to 1000, including when multiplied by nesting"
+	case syntax.ErrInvalidEscape, syntax.ErrTrailingBackslash:
+		msg = "unknown escape sequence, use `\\\\` to match a backslash"
+	case syntax.ErrInvalidCharRange:
+		msg = "invalid character range, ranges like `[a-z]` must go from low to high"
+	case syntax.ErrInvalidPerlOp, syntax.ErrInvalidNamedCapture:
+		msg = "unsupported group syntax, lookaheads and backreferences are not supported"
+	case syntax.ErrNestingDepth, syntax.ErrLarge:
+		return "pattern is too complex, try splitting it into several comparisons joined with OR"
+	default:
+		return syntaxErr.Error()
+	}
+	return fmt.Sprintf("%s (near `%s`)", msg, syntaxErr.Expr)
+}
+
+// globRegex translates a glob, where `*` matches any run of characters and
+// `?` any single character, into an anchored regex
+func globRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`)$`)
+	return b.String()
+}
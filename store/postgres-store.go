@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostgresStore is a Store backed by PostgreSQL, letting several instances of
+// the bot share a database. It runs the same queries as SQLiteStore, which
+// stick to SQL both databases understand, with the ? placeholders rewritten
+// into Postgres' numbered ones.
+type PostgresStore struct {
+	SQLiteStore
+}
+
+func (s PostgresStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return s.withTx(ctx, func(tx SQLiteStore) error {
+		return fn(PostgresStore{tx})
+	})
+}
+
+func NewPostgresStore(db *sql.DB) Store {
+	wrap := func(conn dbtx) dbtx {
+		return postgresConn{conn}
+	}
+	return PostgresStore{SQLiteStore{dbtx: wrap(db), db: db, wrap: wrap}}
+}
+
+// postgresConn adapts queries written for SQLite to Postgres
+type postgresConn struct {
+	conn dbtx
+}
+
+func (c postgresConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.conn.ExecContext(ctx, rebind(query), postgresArgs(args)...)
+}
+
+func (c postgresConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.conn.QueryContext(ctx, rebind(query), postgresArgs(args)...)
+}
+
+func (c postgresConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.conn.QueryRowContext(ctx, rebind(query), postgresArgs(args)...)
+}
+
+// unbound are the parts of a query rebind copies as they are: string
+// literals, quoted identifiers and comments, by how they start and end
+var unbound = []struct{ start, end string }{
+	{"'", "'"},
+	{`"`, `"`},
+	{"--", "\n"},
+	{"/*", "*/"},
+}
+
+// rebind numbers the ? placeholders in query, leaving string literals, quoted
+// identifiers and comments alone
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for i := 0; i < len(query); {
+		skip := -1
+		for k, u := range unbound {
+			if strings.HasPrefix(query[i:], u.start) {
+				skip = k
+				break
+			}
+		}
+		switch {
+		case skip >= 0:
+			// A doubled quote within a literal ends it and starts another
+			// straight away, which comes to the same thing
+			u := unbound[skip]
+			next := len(query)
+			if j := strings.Index(query[i+len(u.start):], u.end); j >= 0 {
+				next = i + len(u.start) + j + len(u.end)
+			}
+			b.WriteString(query[i:next])
+			i = next
+		case query[i] == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			i++
+		default:
+			b.WriteByte(query[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// postgresArgs converts times to UTC, the timestamp columns don't store a
+// time zone and Postgres would otherwise keep the wall clock time of whatever
+// zone the time was in
+func postgresArgs(args []any) []any {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = t.UTC()
+		}
+	}
+	return args
+}
@@ -0,0 +1,24 @@
+package store
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"placeholders", `SELECT a FROM t WHERE b = ? AND c IN (?, ?);`, `SELECT a FROM t WHERE b = $1 AND c IN ($2, $3);`},
+		{"string literal", `SELECT '?', a FROM t WHERE b = ?;`, `SELECT '?', a FROM t WHERE b = $1;`},
+		{"doubled quote", `SELECT 'it''s ?' WHERE b = ?;`, `SELECT 'it''s ?' WHERE b = $1;`},
+		{"quoted identifier", `SELECT "what?" FROM t WHERE b = ?;`, `SELECT "what?" FROM t WHERE b = $1;`},
+		{"line comment", "SELECT a -- why?\nFROM t WHERE b = ?;", "SELECT a -- why?\nFROM t WHERE b = $1;"},
+		{"block comment", `SELECT a /* or b? */ FROM t WHERE b = ?;`, `SELECT a /* or b? */ FROM t WHERE b = $1;`},
+		{"unterminated", `SELECT ? WHERE a = '?`, `SELECT $1 WHERE a = '?`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rebind(tt.query); got != tt.want {
+				t.Errorf("rebind(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
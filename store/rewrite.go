@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// RewriteField is an event field rewrite rules can change
+type RewriteField = string
+
+// RewriteAction is how a rewrite rule changes the field
+type RewriteAction = string
+
+const (
+	RewriteFieldName        RewriteField = FilterFieldName
+	RewriteFieldDescription RewriteField = FilterFieldDescription
+	RewriteFieldLocation    RewriteField = FilterFieldLocation
+
+	// RewriteReplace replaces matches of the regex pattern with text, which
+	// may refer to capture groups as $1 or ${name}
+	RewriteReplace RewriteAction = "replace"
+	// RewriteStrip removes every occurrence of pattern
+	RewriteStrip RewriteAction = "strip"
+	// RewritePrefix adds text to the start of the field
+	RewritePrefix RewriteAction = "prefix"
+	// RewriteSuffix adds text to the end of the field
+	RewriteSuffix RewriteAction = "suffix"
+)
+
+var (
+	RewriteFields  = []RewriteField{RewriteFieldName, RewriteFieldDescription, RewriteFieldLocation}
+	RewriteActions = []RewriteAction{RewriteReplace, RewriteStrip, RewritePrefix, RewriteSuffix}
+)
+
+// RewriteRule changes the text of a calendar's events before they are created
+// on Discord
+type RewriteRule struct {
+	ID      int64
+	URL     string
+	Field   RewriteField
+	Action  RewriteAction
+	Pattern string
+	Text    string
+	re      *regexp.Regexp
+}
+
+// NewRewriteRule checks the rule has what its action needs, compiling the
+// pattern of replace rules.
+func NewRewriteRule(url, field, action, pattern, text string) (*RewriteRule, error) {
+	if !slices.Contains(RewriteFields, field) {
+		return nil, fmt.Errorf("unknown field %q, expected one of %s", field, strings.Join(RewriteFields, ", "))
+	}
+	if len(pattern) > maxPatternLength || len(text) > maxPatternLength {
+		return nil, fmt.Errorf("pattern and text must be at most %d characters", maxPatternLength)
+	}
+	rule := RewriteRule{URL: url, Field: field, Action: action, Pattern: pattern, Text: text}
+	switch action {
+	case RewriteReplace:
+		re, err := compilePattern(pattern, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %s: %w", Quote(pattern), err)
+		}
+		rule.re = re
+	case RewriteStrip:
+		if pattern == "" {
+			return nil, fmt.Errorf("%s needs a pattern", action)
+		}
+	case RewritePrefix, RewriteSuffix:
+		if text == "" {
+			return nil, fmt.Errorf("%s needs text", action)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q, expected one of %s", action, strings.Join(RewriteActions, ", "))
+	}
+	return &rule, nil
+}
+
+func (r RewriteRule) rewrite(s string) string {
+	switch r.Action {
+	case RewriteReplace:
+		return r.re.ReplaceAllString(s, r.Text)
+	case RewriteStrip:
+		return strings.ReplaceAll(s, r.Pattern, "")
+	case RewritePrefix:
+		return r.Text + s
+	case RewriteSuffix:
+		return s + r.Text
+	}
+	return s
+}
+
+func (r RewriteRule) String() string {
+	switch r.Action {
+	case RewriteReplace:
+		return fmt.Sprintf("%s: replace %s with %s", r.Field, Quote(r.Pattern), Quote(r.Text))
+	case RewriteStrip:
+		return fmt.Sprintf("%s: strip %s", r.Field, Quote(r.Pattern))
+	}
+	return fmt.Sprintf("%s: %s %s", r.Field, r.Action, Quote(r.Text))
+}
+
+// RewriteRules are all of the rewrite rules attached to a calendar, applied
+// in the order they were added
+type RewriteRules []RewriteRule
+
+// Apply rewrites the event's name, description and location, trimming the
+// space rules tend to leave behind. A name rewritten to nothing is left as it
+// was since Discord requires one.
+func (rs RewriteRules) Apply(event events.Event) events.Event {
+	if len(rs) == 0 {
+		return event
+	}
+	name := event.Name
+	for _, r := range rs {
+		var field *string
+		switch r.Field {
+		case RewriteFieldName:
+			field = &event.Name
+		case RewriteFieldDescription:
+			field = &event.Description
+		case RewriteFieldLocation:
+			field = &event.Location
+		default:
+			continue
+		}
+		*field = strings.TrimSpace(r.rewrite(*field))
+	}
+	if event.Name == "" {
+		event.Name = name
+	}
+	return event
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"git.phlcode.club/discord-bot/events"
+)
+
+// PrivacyLevel is who can see a calendar's scheduled events
+type PrivacyLevel = string
+
+// PrivacyGuildOnly limits events to members of the guild, which is currently
+// the only privacy level Discord supports for scheduled events
+const PrivacyGuildOnly PrivacyLevel = "guild_only"
+
+var PrivacyLevels = []PrivacyLevel{PrivacyGuildOnly}
+
+const (
+	maxDisplayNameLength = 100
+	maxEmojiLength       = 64
+	maxDefaultDuration   = 7 * 24 * time.Hour
+	maxHorizonDays       = 365
+)
+
+// CalendarSettings customize how a calendar's events are imported
+type CalendarSettings struct {
+	URL string
+	// DisplayName replaces the name given by the remote calendar
+	DisplayName string
+	// Color is the embed color as 0xRRGGBB, 0 for Discord's default
+	Color int
+	// Emoji is prefixed to the names of the calendar's events
+	Emoji        string
+	PrivacyLevel PrivacyLevel
+	// DefaultDuration is the length of events the remote calendar gives no
+	// end for
+	DefaultDuration time.Duration
+	// DefaultLocation is used for events without a location, which Discord
+	// requires for events not hosted in a channel
+	DefaultLocation string
+	// AnnouncementChannelID is the channel newly imported events are posted
+	// to, "" to not announce them
+	AnnouncementChannelID string
+	// HorizonDays limits imports to events starting within that many days,
+	// 0 for no limit
+	HorizonDays int
+}
+
+// DefaultCalendarSettings are the settings of a calendar that has never been
+// configured
+func DefaultCalendarSettings(url string) CalendarSettings {
+	return CalendarSettings{
+		URL:             url,
+		PrivacyLevel:    PrivacyGuildOnly,
+		DefaultDuration: time.Hour,
+	}
+}
+
+// Validate checks the settings are within the limits Discord and the bot
+// accept.
+func (cs CalendarSettings) Validate() error {
+	switch {
+	case len([]rune(cs.DisplayName)) > maxDisplayNameLength:
+		return fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	case cs.Color < 0 || cs.Color > 0xFFFFFF:
+		return fmt.Errorf("color must be a hex RGB color like #5865F2")
+	case len(cs.Emoji) > maxEmojiLength:
+		return fmt.Errorf("emoji must be a single emoji")
+	case !slices.Contains(PrivacyLevels, cs.PrivacyLevel):
+		return fmt.Errorf("unknown privacy level %q", cs.PrivacyLevel)
+	case cs.DefaultDuration < time.Minute || cs.DefaultDuration > maxDefaultDuration:
+		return fmt.Errorf("default duration must be between 1m and %s", maxDefaultDuration)
+	case len([]rune(cs.DefaultLocation)) > 100:
+		return fmt.Errorf("default location must be at most 100 characters")
+	case cs.HorizonDays < 0 || cs.HorizonDays > maxHorizonDays:
+		return fmt.Errorf("horizon must be between 0 and %d days", maxHorizonDays)
+	}
+	return nil
+}
+
+// Apply fills in the event's missing end and location with the defaults and
+// prefixes its name with the emoji.
+func (cs CalendarSettings) Apply(event events.Event) events.Event {
+	if !event.EndTime.After(event.StartTime) {
+		event.EndTime = event.StartTime.Add(cs.DefaultDuration)
+	}
+	if event.Location == "" {
+		event.Location = cs.DefaultLocation
+	}
+	if cs.Emoji != "" {
+		event.Name = cs.Emoji + " " + event.Name
+	}
+	return event
+}
@@ -1,171 +1,872 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"regexp"
+	"strings"
 	"time"
 
 	e "git.phlcode.club/discord-bot/events"
 )
 
+// dbtx is what SQLiteStore needs to run queries, satisfied by both *sql.DB
+// and *sql.Tx
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type SQLiteStore struct {
-	*sql.DB
+	dbtx
+	// db is nil for a store scoped to a transaction
+	db *sql.DB
+	// wrap adapts connections to another database's dialect, see
+	// PostgresStore
+	wrap func(dbtx) dbtx
+}
+
+// WithTx runs fn with a store whose changes are committed together once fn
+// returns without error and rolled back otherwise. Within a transaction fn
+// simply joins it.
+func (s SQLiteStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return s.withTx(ctx, func(tx SQLiteStore) error {
+		return fn(tx)
+	})
 }
 
-func (s SQLiteStore) DeleteEventsByIDs(ids []string) error {
-	// WARN: This is really not the right way to do this...
-	// We should probably revisit it eventually as this is
-	// a potential security risk via SQL injection if we ever use this method without
-	var stmt string
+func (s SQLiteStore) withTx(ctx context.Context, fn func(tx SQLiteStore) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var conn dbtx = tx
+	if s.wrap != nil {
+		conn = s.wrap(tx)
+	}
+	err = fn(SQLiteStore{dbtx: conn, wrap: s.wrap})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s SQLiteStore) DeleteEventsByIDs(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]any, len(ids))
 	for i, id := range ids {
-		if i < len(ids)-1 {
-			stmt += id + ", "
-		} else {
-			stmt += id
-		}
+		args[i] = id
 	}
-	_, err := s.Exec("DELETE FROM events WHERE id in (" + stmt + ");")
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	_, err := s.ExecContext(ctx, "DELETE FROM events WHERE id IN ("+placeholders+");", args...)
 	return err
 }
 
-func (s SQLiteStore) GetEventsByPattern(filter Filter) ([]string, error) {
-	query := "SELECT id, "
-	switch filter.Field {
-	case FilterFieldName:
-		query += "name"
-	case FilterFieldDescription:
-		query += "description"
-	case FilterFieldLocation:
-		query += "location"
-	default:
-		return nil, fmt.Errorf("invalid filter field: %s", filter.Field)
+// eventColumns are the events columns scanned by scanEvents, prefixed with the
+// events table alias e
+const eventColumns = `e.id, e.uid, e.name, e.description, e.start_time, e.end_time, e.location,
+	e.categories, e.organizer, e.url, e.status, e.source_hash, e.channel_id, e.image_url, e.manually_removed, e.edited_fields`
+
+// scanEvents reads every row of a query selecting eventColumns
+func scanEvents(rows *sql.Rows) ([]e.Event, error) {
+	defer rows.Close()
+
+	events := make([]e.Event, 0)
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading events from db: %w", err)
+	}
+	return events, nil
+}
+
+// encodeCategories stores categories as a JSON array, which unlike a comma
+// separated list keeps categories containing commas whole. No categories are
+// stored as an empty string.
+func encodeCategories(categories []string) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(categories)
+	return string(b)
+}
+
+// decodeCategories reads categories stored by encodeCategories
+func decodeCategories(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var categories []string
+	err := json.Unmarshal([]byte(s), &categories)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read event categories: %w", err)
+	}
+	return categories, nil
+}
+
+// scanEvent reads the current row of a query selecting eventColumns followed
+// by the columns scanned into extra
+func scanEvent(rows *sql.Rows, extra ...any) (e.Event, error) {
+	var event e.Event
+	var categories, editedFields string
+	err := rows.Scan(append([]any{&event.ID, &event.UID, &event.Name, &event.Description, &event.StartTime, &event.EndTime, &event.Location,
+		&categories, &event.Organizer, &event.URL, &event.Status, &event.SourceHash, &event.ChannelID, &event.ImageURL,
+		&event.ManuallyRemoved, &editedFields}, extra...)...)
+	if err != nil {
+		return e.Event{}, fmt.Errorf("unable to scan data into Event struct: %w", err)
+	}
+	event.Categories, err = decodeCategories(categories)
+	if err != nil {
+		return e.Event{}, err
+	}
+	if editedFields != "" {
+		event.EditedFields = strings.Split(editedFields, ",")
+	}
+	return event, nil
+}
+
+func (s SQLiteStore) GetEventsForURL(ctx context.Context, url string) ([]e.Event, error) {
+	rows, err := s.QueryContext(ctx, "SELECT "+eventColumns+" FROM events e WHERE e.calendar_url = ?", url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get events from db: %w", err)
+	}
+	return scanEvents(rows)
+}
+
+// GetEventsInRange returns the guild's events that have not ended by from and
+// start before to, sorted by start time. An empty url matches every calendar
+// and a zero to leaves the range open ended.
+func (s SQLiteStore) GetEventsInRange(ctx context.Context, guildID, url string, from, to time.Time) ([]e.Event, error) {
+	query := `SELECT ` + eventColumns + `
+		FROM events e JOIN calendars c ON c.url = e.calendar_url
+		WHERE c.guild_id = ? AND e.end_time >= ? AND NOT e.manually_removed`
+	args := []any{guildID, from.UTC()}
+	if url != "" {
+		query += " AND e.calendar_url = ?"
+		args = append(args, url)
+	}
+	if !to.IsZero() {
+		query += " AND e.start_time < ?"
+		args = append(args, to.UTC())
+	}
+	query += " ORDER BY e.start_time;"
+	rows, err := s.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get events from db: %w", err)
+	}
+	return scanEvents(rows)
+}
+
+func (s SQLiteStore) CreateFilter(ctx context.Context, filter Filter) (Filter, error) {
+	err := s.QueryRowContext(ctx,
+		`INSERT INTO filters (calendar_url, mode, expression, ignore_case) VALUES (?, ?, ?, ?) RETURNING id;`,
+		filter.URL,
+		string(filter.Mode),
+		filter.Expr.String(),
+		filter.IgnoreCase,
+	).Scan(&filter.ID)
+	if err != nil {
+		return Filter{}, err
+	}
+
+	return filter, nil
+}
+
+func (s SQLiteStore) DeleteFilter(ctx context.Context, url string, id int64) (Filter, error) {
+	var mode, expression string
+	var ignoreCase bool
+	err := s.QueryRowContext(ctx,
+		`DELETE FROM filters WHERE id = ? AND calendar_url = ? RETURNING mode, expression, ignore_case;`,
+		id,
+		url).Scan(&mode, &expression, &ignoreCase)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Filter{}, ErrFilterNotFound
 	}
-	query += " FROM events WHERE calendar_url = ?;"
-	rows, err := s.Query(query, filter.URL)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get events by pattern: %w", err)
+		return Filter{}, fmt.Errorf("unable to delete filter: %w", err)
+	}
+	filter, err := NewFilter(url, mode, expression, ignoreCase)
+	if err != nil {
+		return Filter{}, err
+	}
+	filter.ID = id
+	return *filter, nil
+}
+
+func (s SQLiteStore) GetCalendars(ctx context.Context, guildID string) ([]Calendar, error) {
+	rows, err := s.QueryContext(ctx,
+		`SELECT c.url, c.guild_id, c.name, c.last_synced,
+			(SELECT COUNT(*) FROM events e WHERE e.calendar_url = c.url AND e.end_time >= ? AND NOT e.manually_removed)
+		FROM calendars c WHERE c.guild_id = ? ORDER BY c.name, c.url;`,
+		time.Now().UTC(),
+		guildID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get calendars from db: %w", err)
 	}
 	defer rows.Close()
 
-	ids := make([]string, 0)
+	calendars := make([]Calendar, 0)
 	for rows.Next() {
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("error preparing db data for scan: %w", err)
+		var cal Calendar
+		var lastSynced sql.NullTime
+		err = rows.Scan(&cal.URL, &cal.GuildID, &cal.Name, &lastSynced, &cal.EventCount)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into Calendar struct: %w", err)
 		}
+		cal.LastSynced = lastSynced.Time
+		calendars = append(calendars, cal)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading calendars from db: %w", err)
+	}
 
-		var id string
-		var against string
-		err = rows.Scan(&id, &against)
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("unable to scan data into id and pattern match: %w", err)
+	for i := range calendars {
+		calendars[i].Filters, err = s.GetFiltersForURL(ctx, calendars[i].URL)
+		if err != nil {
+			return nil, err
 		}
-		if !filter.Pattern.MatchString(against) {
-			ids = append(ids, id)
+		calendars[i].Settings, err = s.GetCalendarSettings(ctx, calendars[i].URL)
+		if err != nil {
+			return nil, err
 		}
 	}
-	return ids, nil
+	return calendars, nil
 }
 
-func (s SQLiteStore) GetEventsForURL(url string) ([]e.Event, error) {
-	rows, err := s.Query("SELECT id, name, description, start_time, end_time, location FROM events WHERE calendar_url = ?", url)
+func (s SQLiteStore) GetFiltersForURL(ctx context.Context, url string) (Filters, error) {
+	rows, err := s.QueryContext(ctx, `SELECT id, mode, expression, ignore_case FROM filters WHERE calendar_url = ? ORDER BY id;`, url)
 	if err != nil {
-		return nil, fmt.Errorf("unable to get events from db: %w", err)
+		return nil, fmt.Errorf("unable to get filters from db: %w", err)
 	}
 	defer rows.Close()
 
-	events := make([]e.Event, 0)
+	filters := make(Filters, 0)
 	for rows.Next() {
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("error preparing db data for scan: %w", err)
+		var id int64
+		var mode, expression string
+		var ignoreCase bool
+		err = rows.Scan(&id, &mode, &expression, &ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into Filter struct: %w", err)
+		}
+		filter, err := NewFilter(url, mode, expression, ignoreCase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter stored for calendar %s: %w", url, err)
 		}
+		filter.ID = id
+		filters = append(filters, *filter)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading filters from db: %w", err)
+	}
+	return filters, nil
+}
 
-		var event e.Event
-		err = rows.Scan(&event.ID, &event.Name, &event.Description, &event.StartTime, &event.EndTime, &event.Location)
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("unable to scan data into Event struct: %w", err)
+func (s SQLiteStore) InsertCalendar(ctx context.Context, url, guildID, name string, filters Filters) (Filters, error) {
+	stored := make(Filters, 0, len(filters))
+	err := s.withTx(ctx, func(tx SQLiteStore) error {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO calendars (url, guild_id, name, last_synced) VALUES (?, ?, ?, ?);`,
+			url,
+			guildID,
+			name,
+			time.Now().UTC())
+		if err != nil {
+			return err
 		}
-		events = append(events, event)
+		for _, filter := range filters {
+			filter.URL = url
+			created, err := tx.CreateFilter(ctx, filter)
+			if err != nil {
+				return fmt.Errorf("unable to store filter %s: %w", filter.Expr, err)
+			}
+			stored = append(stored, created)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return stored, nil
+}
 
-	return events, nil
+func (s SQLiteStore) InsertEvent(ctx context.Context, url string, e e.Event) (sql.Result, error) {
+	result, err := s.ExecContext(ctx,
+		`INSERT INTO events (calendar_url, id, uid, name, description, start_time, end_time, location, categories, organizer, url, status, source_hash, channel_id, image_url)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		url, e.ID, e.UID, e.Name, e.Description, e.StartTime.UTC(), e.EndTime.UTC(), e.Location,
+		encodeCategories(e.Categories), e.Organizer, e.URL, e.Status, e.SourceHash, e.ChannelID, e.ImageURL)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (s SQLiteStore) CreateFilter(url string, field FilterField, pattern regexp.Regexp) (Filter, error) {
-	_, err := s.Exec(
-		`INSERT INTO filters (calendar_url, field, pattern) VALUES (?, ?, ?);`,
-		url,
-		string(field),
-		pattern.String(),
-	)
+// UpdateEvent overwrites the stored copy of an imported event after it was
+// edited on Discord. Changes made to it by hand are left alone.
+func (s SQLiteStore) UpdateEvent(ctx context.Context, url string, e e.Event) error {
+	_, err := s.ExecContext(ctx,
+		`UPDATE events SET uid = ?, name = ?, description = ?, start_time = ?, end_time = ?, location = ?,
+			categories = ?, organizer = ?, url = ?, status = ?, source_hash = ?, channel_id = ?, image_url = ?
+		WHERE id = ? AND calendar_url = ?;`,
+		e.UID, e.Name, e.Description, e.StartTime.UTC(), e.EndTime.UTC(), e.Location,
+		encodeCategories(e.Categories), e.Organizer, e.URL, e.Status, e.SourceHash, e.ChannelID, e.ImageURL,
+		e.ID, url)
+	return err
+}
+
+// GetEvent returns the imported event with the scheduled event ID along with
+// the URL of its calendar
+func (s SQLiteStore) GetEvent(ctx context.Context, id string) (string, e.Event, error) {
+	rows, err := s.QueryContext(ctx, "SELECT "+eventColumns+", e.calendar_url FROM events e WHERE e.id = ?", id)
 	if err != nil {
-		return Filter{}, err
+		return "", e.Event{}, fmt.Errorf("unable to get event from db: %w", err)
 	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", e.Event{}, fmt.Errorf("error reading event from db: %w", err)
+		}
+		return "", e.Event{}, ErrEventNotFound
+	}
+	var url string
+	event, err := scanEvent(rows, &url)
+	return url, event, err
+}
 
-	return Filter{URL: url, Field: field, Pattern: pattern}, nil
+func (s SQLiteStore) MarkEventRemoved(ctx context.Context, id string) error {
+	_, err := s.ExecContext(ctx, `UPDATE events SET manually_removed = TRUE WHERE id = ?;`, id)
+	return err
 }
 
-func (s SQLiteStore) DeleteFilter(url string, field FilterField, pattern regexp.Regexp) error {
-	panic("unimplemented")
+func (s SQLiteStore) SetEditedFields(ctx context.Context, id string, fields []string) error {
+	_, err := s.ExecContext(ctx, `UPDATE events SET edited_fields = ? WHERE id = ?;`, strings.Join(fields, ","), id)
+	return err
 }
 
-func (s SQLiteStore) InsertURL(url string) (sql.Result, error) {
-	result, err := s.Exec(
-		`INSERT INTO calendars (url, last_synced) VALUES (?, ?);`,
-		url,
-		time.Now())
+func (s SQLiteStore) GetRewriteRules(ctx context.Context, url string) (RewriteRules, error) {
+	rows, err := s.QueryContext(ctx, `SELECT id, field, action, pattern, text FROM rewrite_rules WHERE calendar_url = ? ORDER BY id;`, url)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("unable to get rewrite rules from db: %w", err)
 	}
+	defer rows.Close()
 
-	return result, nil
+	rules := make(RewriteRules, 0)
+	for rows.Next() {
+		var id int64
+		var field, action, pattern, text string
+		err = rows.Scan(&id, &field, &action, &pattern, &text)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into RewriteRule struct: %w", err)
+		}
+		rule, err := NewRewriteRule(url, field, action, pattern, text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite rule stored for calendar %s: %w", url, err)
+		}
+		rule.ID = id
+		rules = append(rules, *rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rewrite rules from db: %w", err)
+	}
+	return rules, nil
 }
 
-func (s SQLiteStore) InsertEvent(url string, e e.Event) (sql.Result, error) {
-	result, err := s.Exec(
-		`INSERT INTO events (calendar_url, id, name, description, start_time, end_time, location) VALUES (?, ?, ?, ?, ?, ?, ?);`,
-		url, e.ID, e.Name, e.Description, e.StartTime, e.EndTime, e.Location)
+func (s SQLiteStore) CreateRewriteRule(ctx context.Context, rule RewriteRule) (RewriteRule, error) {
+	err := s.QueryRowContext(ctx,
+		`INSERT INTO rewrite_rules (calendar_url, field, action, pattern, text) VALUES (?, ?, ?, ?, ?) RETURNING id;`,
+		rule.URL,
+		rule.Field,
+		rule.Action,
+		rule.Pattern,
+		rule.Text,
+	).Scan(&rule.ID)
 	if err != nil {
-		return nil, err
+		return RewriteRule{}, err
 	}
-	return result, nil
+	return rule, nil
 }
 
-func (s SQLiteStore) DeleteCalendarByURL(url string) (sql.Result, error) {
-	result, err := s.Exec(
-		`DELETE FROM calendars WHERE url = ?;`,
-		url)
+func (s SQLiteStore) DeleteRewriteRule(ctx context.Context, url string, id int64) (RewriteRule, error) {
+	var field, action, pattern, text string
+	err := s.QueryRowContext(ctx,
+		`DELETE FROM rewrite_rules WHERE id = ? AND calendar_url = ? RETURNING field, action, pattern, text;`,
+		id,
+		url).Scan(&field, &action, &pattern, &text)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RewriteRule{}, ErrRewriteRuleNotFound
+	}
 	if err != nil {
-		return nil, err
+		return RewriteRule{}, fmt.Errorf("unable to delete rewrite rule: %w", err)
 	}
-	return result, nil
+	rule, err := NewRewriteRule(url, field, action, pattern, text)
+	if err != nil {
+		return RewriteRule{}, err
+	}
+	rule.ID = id
+	return *rule, nil
 }
 
-func (s SQLiteStore) DeleteEventsByURL(url string) ([]string, error) {
-	rows, err := s.Query(
-		`DELETE FROM events WHERE calendar_url = ? RETURNING id;`,
-		url)
+func (s SQLiteStore) GetCalendar(ctx context.Context, url string) (Calendar, error) {
+	var cal Calendar
+	var lastSynced sql.NullTime
+	err := s.QueryRowContext(ctx,
+		`SELECT c.url, c.guild_id, c.name, c.last_synced,
+			(SELECT COUNT(*) FROM events e WHERE e.calendar_url = c.url AND e.end_time >= ? AND NOT e.manually_removed)
+		FROM calendars c WHERE c.url = ?;`,
+		time.Now().UTC(),
+		url).Scan(&cal.URL, &cal.GuildID, &cal.Name, &lastSynced, &cal.EventCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Calendar{}, ErrCalendarNotFound
+	}
 	if err != nil {
-		return nil, err
+		return Calendar{}, fmt.Errorf("unable to get calendar from db: %w", err)
+	}
+	cal.LastSynced = lastSynced.Time
+	cal.Filters, err = s.GetFiltersForURL(ctx, url)
+	if err != nil {
+		return Calendar{}, err
+	}
+	cal.Settings, err = s.GetCalendarSettings(ctx, url)
+	if err != nil {
+		return Calendar{}, err
+	}
+	return cal, nil
+}
+
+// GetCalendarCover returns the data URI of the calendar's default cover image,
+// or "" if it has none.
+func (s SQLiteStore) GetCalendarCover(ctx context.Context, url string) (string, error) {
+	var cover string
+	err := s.QueryRowContext(ctx, `SELECT cover_image FROM calendars WHERE url = ?;`, url).Scan(&cover)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrCalendarNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get calendar cover from db: %w", err)
+	}
+	return cover, nil
+}
+
+func (s SQLiteStore) SetCalendarCover(ctx context.Context, url, cover string) error {
+	_, err := s.ExecContext(ctx, `UPDATE calendars SET cover_image = ? WHERE url = ?;`, cover, url)
+	return err
+}
+
+// GetCalendarSettings returns the calendar's settings, or the defaults if
+// they have never been changed.
+func (s SQLiteStore) GetCalendarSettings(ctx context.Context, url string) (CalendarSettings, error) {
+	settings := DefaultCalendarSettings(url)
+	var minutes int64
+	err := s.QueryRowContext(ctx,
+		`SELECT display_name, color, emoji, privacy_level, default_duration_minutes, default_location, announcement_channel_id, horizon_days
+		FROM calendar_settings WHERE calendar_url = ?;`,
+		url).Scan(&settings.DisplayName, &settings.Color, &settings.Emoji, &settings.PrivacyLevel, &minutes,
+		&settings.DefaultLocation, &settings.AnnouncementChannelID, &settings.HorizonDays)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return CalendarSettings{}, fmt.Errorf("unable to get calendar settings from db: %w", err)
+	}
+	settings.DefaultDuration = time.Duration(minutes) * time.Minute
+	return settings, nil
+}
+
+func (s SQLiteStore) SetCalendarSettings(ctx context.Context, settings CalendarSettings) error {
+	_, err := s.ExecContext(ctx,
+		`INSERT INTO calendar_settings (calendar_url, display_name, color, emoji, privacy_level, default_duration_minutes, default_location, announcement_channel_id, horizon_days)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (calendar_url) DO UPDATE SET
+			display_name = excluded.display_name,
+			color = excluded.color,
+			emoji = excluded.emoji,
+			privacy_level = excluded.privacy_level,
+			default_duration_minutes = excluded.default_duration_minutes,
+			default_location = excluded.default_location,
+			announcement_channel_id = excluded.announcement_channel_id,
+			horizon_days = excluded.horizon_days;`,
+		settings.URL,
+		settings.DisplayName,
+		settings.Color,
+		settings.Emoji,
+		settings.PrivacyLevel,
+		int64(settings.DefaultDuration/time.Minute),
+		settings.DefaultLocation,
+		settings.AnnouncementChannelID,
+		settings.HorizonDays)
+	return err
+}
+
+func (s SQLiteStore) LockCalendar(ctx context.Context, url string) error {
+	// Writing the row makes other transactions locking it wait for this one
+	res, err := s.ExecContext(ctx, `UPDATE calendars SET url = url WHERE url = ?;`, url)
+	if err != nil {
+		return fmt.Errorf("unable to lock calendar: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to lock calendar: %w", err)
+	}
+	if n == 0 {
+		return ErrCalendarNotFound
+	}
+	return nil
+}
+
+func (s SQLiteStore) UpdateLastSynced(ctx context.Context, url string) error {
+	_, err := s.ExecContext(ctx, `UPDATE calendars SET last_synced = ? WHERE url = ?;`, time.Now().UTC(), url)
+	return err
+}
+
+// ClaimCalendarPolls marks the calendars last polled before since, or never,
+// as polled now and returns them with just their URL and guild set. The claim
+// is a single statement so instances sharing the database never both poll a
+// calendar. Calendars without a guild are left alone.
+func (s SQLiteStore) ClaimCalendarPolls(ctx context.Context, since time.Time) ([]Calendar, error) {
+	rows, err := s.QueryContext(ctx,
+		`UPDATE calendars SET polled_at = ?
+		WHERE guild_id != '' AND (polled_at IS NULL OR polled_at < ?)
+		RETURNING url, guild_id;`,
+		time.Now().UTC(),
+		since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("unable to claim calendar polls: %w", err)
 	}
 	defer rows.Close()
 
-	ids := make([]string, 0)
+	calendars := make([]Calendar, 0)
 	for rows.Next() {
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("error preparing db data for scan: %w", err)
+		var cal Calendar
+		err = rows.Scan(&cal.URL, &cal.GuildID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into Calendar struct: %w", err)
 		}
+		calendars = append(calendars, cal)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading claimed calendars from db: %w", err)
+	}
+	return calendars, nil
+}
 
-		var id string
-		err = rows.Scan(&id)
-		if rows.Err() != nil {
-			return nil, fmt.Errorf("unable to scan data into Event struct: %w", err)
+// SetCalendarGuild moves the calendar to the guild, for calendars subscribed
+// before calendars belonged to one
+func (s SQLiteStore) SetCalendarGuild(ctx context.Context, url, guildID string) error {
+	_, err := s.ExecContext(ctx, `UPDATE calendars SET guild_id = ? WHERE url = ?;`, guildID, url)
+	return err
+}
+
+func (s SQLiteStore) GetChannelRules(ctx context.Context, url string) (ChannelRules, error) {
+	rows, err := s.QueryContext(ctx, `SELECT id, pattern_type, pattern, channel_id FROM channel_rules WHERE calendar_url = ? ORDER BY id;`, url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get channel rules from db: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make(ChannelRules, 0)
+	for rows.Next() {
+		var id int64
+		var patternType, pattern, channelID string
+		err = rows.Scan(&id, &patternType, &pattern, &channelID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into ChannelRule struct: %w", err)
 		}
-		ids = append(ids, id)
+		rule, err := NewChannelRule(url, patternType, pattern, channelID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel rule stored for calendar %s: %w", url, err)
+		}
+		rule.ID = id
+		rules = append(rules, *rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading channel rules from db: %w", err)
+	}
+	return rules, nil
+}
+
+func (s SQLiteStore) CreateChannelRule(ctx context.Context, rule ChannelRule) (ChannelRule, error) {
+	err := s.QueryRowContext(ctx,
+		`INSERT INTO channel_rules (calendar_url, pattern_type, pattern, channel_id) VALUES (?, ?, ?, ?) RETURNING id;`,
+		rule.URL,
+		rule.PatternType,
+		rule.Pattern,
+		rule.ChannelID,
+	).Scan(&rule.ID)
+	if err != nil {
+		return ChannelRule{}, err
+	}
+	return rule, nil
+}
+
+func (s SQLiteStore) DeleteChannelRule(ctx context.Context, url string, id int64) (ChannelRule, error) {
+	var patternType, pattern, channelID string
+	err := s.QueryRowContext(ctx,
+		`DELETE FROM channel_rules WHERE id = ? AND calendar_url = ? RETURNING pattern_type, pattern, channel_id;`,
+		id,
+		url).Scan(&patternType, &pattern, &channelID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ChannelRule{}, ErrChannelRuleNotFound
+	}
+	if err != nil {
+		return ChannelRule{}, fmt.Errorf("unable to delete channel rule: %w", err)
 	}
-	return ids, nil
+	rule, err := NewChannelRule(url, patternType, pattern, channelID)
+	if err != nil {
+		return ChannelRule{}, err
+	}
+	rule.ID = id
+	return *rule, nil
+}
+
+// GetGuildTimezone returns the timezone configured for the guild, defaulting
+// to UTC when none has been set.
+func (s SQLiteStore) GetGuildTimezone(ctx context.Context, guildID string) (*time.Location, error) {
+	var name string
+	err := s.QueryRowContext(ctx, `SELECT timezone FROM guilds WHERE guild_id = ?;`, guildID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.UTC, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get guild timezone from db: %w", err)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone stored for guild %s: %w", guildID, err)
+	}
+	return loc, nil
+}
+
+func (s SQLiteStore) SetGuildTimezone(ctx context.Context, guildID string, loc *time.Location) error {
+	_, err := s.ExecContext(ctx,
+		`INSERT INTO guilds (guild_id, timezone) VALUES (?, ?)
+		ON CONFLICT (guild_id) DO UPDATE SET timezone = excluded.timezone;`,
+		guildID,
+		loc.String())
+	return err
+}
+
+// DeleteCalendar removes the calendar along with its events, filters, rewrite
+// rules, channel rules and settings in a single transaction.
+func (s SQLiteStore) DeleteCalendar(ctx context.Context, url string) error {
+	return s.withTx(ctx, func(tx SQLiteStore) error {
+		for _, stmt := range []string{
+			`DELETE FROM events WHERE calendar_url = ?;`,
+			`DELETE FROM filters WHERE calendar_url = ?;`,
+			`DELETE FROM rewrite_rules WHERE calendar_url = ?;`,
+			`DELETE FROM channel_rules WHERE calendar_url = ?;`,
+			`DELETE FROM calendar_settings WHERE calendar_url = ?;`,
+			`DELETE FROM calendars WHERE url = ?;`,
+		} {
+			_, err := tx.ExecContext(ctx, stmt, url)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const opColumns = `o.id, o.batch_id, o.kind, b.guild_id, b.calendar_url, o.event, o.status, o.started, o.attempts, o.next_attempt_at, o.error, o.leased_until`
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func scanOps(rows *sql.Rows) ([]Op, error) {
+	defer rows.Close()
+
+	ops := make([]Op, 0)
+	for rows.Next() {
+		var op Op
+		var event string
+		var leasedUntil sql.NullTime
+		err := rows.Scan(&op.ID, &op.BatchID, &op.Kind, &op.GuildID, &op.URL, &event, &op.Status, &op.Started, &op.Attempts, &op.NextAttempt, &op.Error, &leasedUntil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into Op struct: %w", err)
+		}
+		op.LeasedUntil = leasedUntil.Time
+		err = json.Unmarshal([]byte(event), &op.Event)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode event of op %d: %w", op.ID, err)
+		}
+		ops = append(ops, op)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ops from db: %w", err)
+	}
+	return ops, nil
+}
+
+func (s SQLiteStore) QueueOps(ctx context.Context, batch OpBatch, ops []Op) (OpBatch, error) {
+	err := s.withTx(ctx, func(tx SQLiteStore) error {
+		batch.CreatedAt = time.Now().UTC()
+		err := tx.QueryRowContext(ctx,
+			`INSERT INTO discord_op_batches (action, guild_id, calendar_url, application_id, interaction_id, interaction_token, created_at, awaited_until)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id;`,
+			batch.Action, batch.GuildID, batch.URL, batch.ApplicationID, batch.InteractionID, batch.InteractionToken, batch.CreatedAt,
+			nullTime(batch.AwaitedUntil)).Scan(&batch.ID)
+		if err != nil {
+			return fmt.Errorf("unable to store op batch: %w", err)
+		}
+		for _, op := range ops {
+			event, err := json.Marshal(op.Event)
+			if err != nil {
+				return fmt.Errorf("unable to encode event %s: %w", op.Event.Name, err)
+			}
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO discord_ops (batch_id, kind, event, status, next_attempt_at) VALUES (?, ?, ?, ?, ?);`,
+				batch.ID, op.Kind, string(event), OpPending, batch.CreatedAt)
+			if err != nil {
+				return fmt.Errorf("unable to store op: %w", err)
+			}
+		}
+		return nil
+	})
+	return batch, err
+}
+
+func (s SQLiteStore) GetPendingOps(ctx context.Context) ([]Op, error) {
+	rows, err := s.QueryContext(ctx,
+		"SELECT "+opColumns+` FROM discord_ops o JOIN discord_op_batches b ON b.id = o.batch_id
+		WHERE o.status = ? ORDER BY o.next_attempt_at, o.id;`, OpPending)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get pending ops from db: %w", err)
+	}
+	return scanOps(rows)
+}
+
+func (s SQLiteStore) GetOps(ctx context.Context, batchID int64) ([]Op, error) {
+	rows, err := s.QueryContext(ctx,
+		"SELECT "+opColumns+` FROM discord_ops o JOIN discord_op_batches b ON b.id = o.batch_id
+		WHERE o.batch_id = ? ORDER BY o.id;`, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get ops from db: %w", err)
+	}
+	return scanOps(rows)
+}
+
+func (s SQLiteStore) UpdateOp(ctx context.Context, op Op) error {
+	event, err := json.Marshal(op.Event)
+	if err != nil {
+		return fmt.Errorf("unable to encode event %s: %w", op.Event.Name, err)
+	}
+	_, err = s.ExecContext(ctx,
+		`UPDATE discord_ops SET event = ?, status = ?, started = ?, attempts = ?, next_attempt_at = ?, error = ?, leased_until = ? WHERE id = ?;`,
+		string(event), op.Status, op.Started, op.Attempts, op.NextAttempt.UTC(), op.Error, nullTime(op.LeasedUntil), op.ID)
+	return err
+}
+
+// ClaimOp leases the op to the caller until the given time, as long as it is
+// pending, due and not leased to another instance, and returns it as it is
+// now. The claim is a single conditional update, which Postgres re-checks
+// against the row once a concurrent claim commits, so instances sharing the
+// database never both claim an op.
+func (s SQLiteStore) ClaimOp(ctx context.Context, id int64, until time.Time) (Op, bool, error) {
+	var op Op
+	var claimed bool
+	err := s.withTx(ctx, func(tx SQLiteStore) error {
+		now := time.Now().UTC()
+		result, err := tx.ExecContext(ctx,
+			`UPDATE discord_ops SET leased_until = ?
+			WHERE id = ? AND status = ? AND next_attempt_at <= ? AND (leased_until IS NULL OR leased_until < ?);`,
+			until.UTC(), id, OpPending, now, now)
+		if err != nil {
+			return fmt.Errorf("unable to claim op: %w", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx,
+			"SELECT "+opColumns+` FROM discord_ops o JOIN discord_op_batches b ON b.id = o.batch_id WHERE o.id = ?;`, id)
+		if err != nil {
+			return fmt.Errorf("unable to get claimed op from db: %w", err)
+		}
+		ops, err := scanOps(rows)
+		if err != nil || len(ops) == 0 {
+			return err
+		}
+		op, claimed = ops[0], true
+		return nil
+	})
+	return op, claimed, err
+}
+
+const opBatchColumns = `id, action, guild_id, calendar_url, application_id, interaction_id, interaction_token, created_at, awaited_until`
+
+func scanOpBatch(row interface{ Scan(...any) error }) (OpBatch, error) {
+	var batch OpBatch
+	var awaitedUntil sql.NullTime
+	err := row.Scan(&batch.ID, &batch.Action, &batch.GuildID, &batch.URL, &batch.ApplicationID, &batch.InteractionID, &batch.InteractionToken, &batch.CreatedAt, &awaitedUntil)
+	batch.AwaitedUntil = awaitedUntil.Time
+	return batch, err
+}
+
+func (s SQLiteStore) GetOpBatch(ctx context.Context, id int64) (OpBatch, error) {
+	batch, err := scanOpBatch(s.QueryRowContext(ctx, "SELECT "+opBatchColumns+" FROM discord_op_batches WHERE id = ?;", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return OpBatch{}, ErrOpBatchNotFound
+	}
+	return batch, err
+}
+
+func (s SQLiteStore) GetOpBatches(ctx context.Context) ([]OpBatch, error) {
+	rows, err := s.QueryContext(ctx, "SELECT "+opBatchColumns+" FROM discord_op_batches ORDER BY id;")
+	if err != nil {
+		return nil, fmt.Errorf("unable to get op batches from db: %w", err)
+	}
+	defer rows.Close()
+	batches := make([]OpBatch, 0)
+	for rows.Next() {
+		batch, err := scanOpBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan data into OpBatch struct: %w", err)
+		}
+		batches = append(batches, batch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading op batches from db: %w", err)
+	}
+	return batches, nil
+}
+
+// DeleteOpBatch removes the batch along with its ops in a single transaction,
+// returning ErrOpBatchNotFound if it was already removed.
+func (s SQLiteStore) DeleteOpBatch(ctx context.Context, id int64) error {
+	return s.withTx(ctx, func(tx SQLiteStore) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM discord_ops WHERE batch_id = ?;`, id)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM discord_op_batches WHERE id = ?;`, id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err == nil && n == 0 {
+			return ErrOpBatchNotFound
+		}
+		return err
+	})
 }
 
 func NewSQLiteStore(db *sql.DB) Store {
-	return SQLiteStore{db}
+	return SQLiteStore{dbtx: db, db: db}
 }
@@ -1,67 +1,248 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"regexp"
+	"slices"
+	"time"
 
 	"git.phlcode.club/discord-bot/events"
 )
 
+var (
+	ErrCalendarNotFound    = errors.New("calendar not found")
+	ErrFilterNotFound      = errors.New("filter not found")
+	ErrRewriteRuleNotFound = errors.New("rewrite rule not found")
+	ErrChannelRuleNotFound = errors.New("channel rule not found")
+	ErrOpBatchNotFound     = errors.New("op batch not found")
+	ErrEventNotFound       = errors.New("event not found")
+)
+
 type FilterField = string
 
 const (
 	FilterFieldName        = "name"
 	FilterFieldDescription = "description"
 	FilterFieldLocation    = "location"
+	// FilterFieldCategories matches if any of the event's CATEGORIES match
+	FilterFieldCategories = "categories"
+	FilterFieldOrganizer  = "organizer"
+	FilterFieldURL        = "url"
+	// FilterFieldStatus is the iCal STATUS: TENTATIVE, CONFIRMED or CANCELLED
+	FilterFieldStatus = "status"
+	// FilterFieldWeekday is the day of the week the event starts on
+	FilterFieldWeekday = "weekday"
+	// FilterFieldTime is the time of day the event starts at
+	FilterFieldTime = "time"
+	// FilterFieldDuration is how long the event lasts
+	FilterFieldDuration = "duration"
+	// FilterFieldDate is the date the event starts on
+	FilterFieldDate = "date"
+)
+
+// FilterMode decides what happens to events matching a filter
+type FilterMode = string
+
+const (
+	// FilterModeInclude keeps events matching the filter
+	FilterModeInclude = "include"
+	// FilterModeExclude drops events matching the filter
+	FilterModeExclude = "exclude"
 )
 
-func NewFilter(url, field, pattern string) (*Filter, error) {
+var filterFields = []FilterField{
+	FilterFieldName,
+	FilterFieldDescription,
+	FilterFieldLocation,
+	FilterFieldCategories,
+	FilterFieldOrganizer,
+	FilterFieldURL,
+	FilterFieldStatus,
+	FilterFieldWeekday,
+	FilterFieldTime,
+	FilterFieldDuration,
+	FilterFieldDate,
+}
+
+// TextFields are the fields matched against text, as opposed to the time
+// based fields
+var TextFields = []FilterField{
+	FilterFieldName,
+	FilterFieldDescription,
+	FilterFieldLocation,
+	FilterFieldCategories,
+	FilterFieldOrganizer,
+	FilterFieldURL,
+	FilterFieldStatus,
+}
+
+// TextFieldsWithValues returns the text fields set on at least one of the
+// events, i.e. the fields worth filtering a calendar's events on.
+func TextFieldsWithValues(evts []events.Event) []FilterField {
+	fields := make([]FilterField, 0, len(TextFields))
+	for _, field := range TextFields {
+		for _, event := range evts {
+			if slices.ContainsFunc(fieldValues(event, field), func(v string) bool { return v != "" }) {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+func isFilterField(field string) bool {
+	return slices.Contains(filterFields, field)
+}
+
+// NewFilter parses the filter expression, see ParseExpr for the syntax. When
+// ignoreCase is set the expression's text comparisons ignore case.
+func NewFilter(url, mode, expression string, ignoreCase bool) (*Filter, error) {
 	var filter Filter
 	filter.URL = url
-	switch field {
-	case FilterFieldName:
-	case FilterFieldDescription:
-	case FilterFieldLocation:
+	switch mode {
+	case FilterModeInclude:
+	case FilterModeExclude:
 	default:
-		return nil, fmt.Errorf("unexpected filter field value: %s", field)
+		return nil, fmt.Errorf("unexpected filter mode value: %s", mode)
 	}
-	filter.Field = FilterField(field)
-	regex, err := regexp.Compile(pattern)
+	filter.Mode = FilterMode(mode)
+	expr, err := ParseExpr(expression, ignoreCase)
 	if err != nil {
-		return nil, fmt.Errorf("invalid filter pattern: %s", pattern)
+		return nil, err
 	}
-	filter.Pattern = *regex
+	filter.Expr = expr
+	filter.IgnoreCase = ignoreCase
 	return &filter, nil
 }
 
 type Filter struct {
-	URL     string
-	Field   FilterField
-	Pattern regexp.Regexp
+	ID         int64
+	URL        string
+	Mode       FilterMode
+	Expr       Expr
+	IgnoreCase bool
+}
+
+// Matches reports whether the event satisfies the filter's expression,
+// regardless of the filter's mode. Time based fields are evaluated in loc.
+func (f Filter) Matches(event events.Event, loc *time.Location) bool {
+	return f.Expr.Eval(event, loc)
+}
+
+// Filters are all of the filters attached to a calendar
+type Filters []Filter
+
+// Keep reports whether an event passes the filters. An event is kept when it
+// matches none of the exclude filters and, if there are any include filters,
+// matches at least one of them. In other words include filters are OR'd
+// together, exclude filters are OR'd together, and exclusion always wins.
+func (fs Filters) Keep(event events.Event, loc *time.Location) bool {
+	hasInclude, included := false, false
+	for _, f := range fs {
+		switch f.Mode {
+		case FilterModeExclude:
+			if f.Matches(event, loc) {
+				return false
+			}
+		default:
+			hasInclude = true
+			included = included || f.Matches(event, loc)
+		}
+	}
+	return !hasInclude || included
 }
 
-func (f Filter) Filter(event events.Event) bool {
-	var against string
-	switch f.Field {
-	case FilterFieldName:
-		against = event.Name
-	case FilterFieldDescription:
-		against = event.Description
-	case FilterFieldLocation:
-		against = event.Location
+// Calendar is a subscribed remote calendar along with a summary of what has
+// been imported from it.
+type Calendar struct {
+	URL        string
+	GuildID    string
+	Name       string
+	LastSynced time.Time
+	// EventCount is the number of imported events that have not ended yet
+	EventCount int
+	Filters    Filters
+	Settings   CalendarSettings
+}
+
+// DisplayName returns the display name set for the calendar or the name given
+// by the remote calendar, falling back to the URL when neither is set.
+func (c Calendar) DisplayName() string {
+	if c.Settings.DisplayName != "" {
+		return c.Settings.DisplayName
+	}
+	if c.Name != "" {
+		return c.Name
 	}
-	return f.Pattern.MatchString(against)
+	return c.URL
 }
 
 type Store interface {
-	InsertURL(url string) (sql.Result, error)
-	InsertEvent(url string, e events.Event) (sql.Result, error)
-	DeleteCalendarByURL(url string) (sql.Result, error)
-	DeleteEventsByURL(url string) ([]string, error)
-	DeleteEventsByIDs(ids []string) error
-	GetEventsByPattern(filter Filter) ([]string, error)
-	GetEventsForURL(url string) ([]events.Event, error)
-	CreateFilter(url string, field FilterField, pattern regexp.Regexp) (Filter, error)
-	DeleteFilter(url string, field FilterField, pattern regexp.Regexp) error
+	// WithTx runs fn against a store scoped to a transaction, committing its
+	// changes only if fn succeeds so they are applied all-or-nothing
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+	// InsertCalendar stores the calendar along with its initial filters in a
+	// single transaction, returning the filters with their IDs set
+	InsertCalendar(ctx context.Context, url, guildID, name string, filters Filters) (Filters, error)
+	InsertEvent(ctx context.Context, url string, e events.Event) (sql.Result, error)
+	GetCalendar(ctx context.Context, url string) (Calendar, error)
+	// LockCalendar holds the calendar until the transaction ends, so changes
+	// planned from its stored events are queued one at a time, returning
+	// ErrCalendarNotFound if it has been unsubscribed from
+	LockCalendar(ctx context.Context, url string) error
+	UpdateLastSynced(ctx context.Context, url string) error
+	// ClaimCalendarPolls marks the calendars last polled before since, or
+	// never, as polled now and returns them with just their URL and guild set
+	ClaimCalendarPolls(ctx context.Context, since time.Time) ([]Calendar, error)
+	// SetCalendarGuild moves the calendar to the guild, for calendars
+	// subscribed before calendars belonged to one
+	SetCalendarGuild(ctx context.Context, url, guildID string) error
+	GetCalendarCover(ctx context.Context, url string) (string, error)
+	SetCalendarCover(ctx context.Context, url, cover string) error
+	GetCalendarSettings(ctx context.Context, url string) (CalendarSettings, error)
+	SetCalendarSettings(ctx context.Context, settings CalendarSettings) error
+	GetGuildTimezone(ctx context.Context, guildID string) (*time.Location, error)
+	SetGuildTimezone(ctx context.Context, guildID string, loc *time.Location) error
+	DeleteCalendar(ctx context.Context, url string) error
+	DeleteEventsByIDs(ctx context.Context, ids []string) error
+	GetEventsForURL(ctx context.Context, url string) ([]events.Event, error)
+	GetEventsInRange(ctx context.Context, guildID, url string, from, to time.Time) ([]events.Event, error)
+	GetCalendars(ctx context.Context, guildID string) ([]Calendar, error)
+	GetFiltersForURL(ctx context.Context, url string) (Filters, error)
+	CreateFilter(ctx context.Context, filter Filter) (Filter, error)
+	DeleteFilter(ctx context.Context, url string, id int64) (Filter, error)
+	UpdateEvent(ctx context.Context, url string, e events.Event) error
+	// GetEvent returns the imported event with the scheduled event ID along
+	// with the URL of its calendar
+	GetEvent(ctx context.Context, id string) (string, events.Event, error)
+	// MarkEventRemoved records that the event's scheduled event was deleted
+	// by hand
+	MarkEventRemoved(ctx context.Context, id string) error
+	// SetEditedFields records which of the event's fields were edited by hand
+	SetEditedFields(ctx context.Context, id string, fields []string) error
+	GetRewriteRules(ctx context.Context, url string) (RewriteRules, error)
+	CreateRewriteRule(ctx context.Context, rule RewriteRule) (RewriteRule, error)
+	DeleteRewriteRule(ctx context.Context, url string, id int64) (RewriteRule, error)
+	GetChannelRules(ctx context.Context, url string) (ChannelRules, error)
+	CreateChannelRule(ctx context.Context, rule ChannelRule) (ChannelRule, error)
+	DeleteChannelRule(ctx context.Context, url string, id int64) (ChannelRule, error)
+	// QueueOps stores the batch and its operations, which start out pending
+	// and due straight away, returning the batch with its ID set
+	QueueOps(ctx context.Context, batch OpBatch, ops []Op) (OpBatch, error)
+	// GetPendingOps returns every pending operation, the soonest due first
+	GetPendingOps(ctx context.Context) ([]Op, error)
+	GetOps(ctx context.Context, batchID int64) ([]Op, error)
+	UpdateOp(ctx context.Context, op Op) error
+	// ClaimOp leases the op to the caller until the given time if it is
+	// pending, due and not leased to another instance, returning it as it is
+	// now and whether it was claimed
+	ClaimOp(ctx context.Context, id int64, until time.Time) (Op, bool, error)
+	GetOpBatch(ctx context.Context, id int64) (OpBatch, error)
+	GetOpBatches(ctx context.Context) ([]OpBatch, error)
+	// DeleteOpBatch removes the batch and its ops, returning
+	// ErrOpBatchNotFound if it was already removed
+	DeleteOpBatch(ctx context.Context, id int64) error
 }
@@ -41,7 +41,10 @@ func ParseTime(value string) (time.Time, error) {
 type Env struct {
 	DiscordToken string
 	DiscordAppID string
-	DBPath       string
+	// DBDriver is the database to store calendars in, sqlite or postgres
+	DBDriver string
+	// DBDSN is the SQLite file path or Postgres connection string
+	DBDSN string
 }
 
 // check for env variable, to load dot env file
@@ -72,12 +75,25 @@ func InitEnv() {
 		os.Exit(64)
 	}
 
-	path, exists := os.LookupEnv("DB_PATH")
+	driver, exists := os.LookupEnv("DB_DRIVER")
 	if !exists {
-		path = "/calendars.db"
+		driver = "sqlite"
 	}
 
-	e = Env{DBPath: path, DiscordToken: token, DiscordAppID: id}
+	dsn, exists := os.LookupEnv("DB_DSN")
+	if !exists {
+		// DB_PATH predates Postgres support and is still honoured for SQLite
+		dsn, exists = os.LookupEnv("DB_PATH")
+	}
+	if !exists && driver == "sqlite" {
+		dsn = "/calendars.db"
+	}
+	if dsn == "" {
+		slog.Error("specify the DB_DSN environment variable")
+		os.Exit(64)
+	}
+
+	e = Env{DBDriver: driver, DBDSN: dsn, DiscordToken: token, DiscordAppID: id}
 }
 
 func GetEnv() Env {